@@ -0,0 +1,86 @@
+package analysis
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/verybigtuple/hackvmtranslator/parser"
+)
+
+// Node is a function of the call graph
+type Node struct {
+	Name   string `json:"name"`
+	File   string `json:"file"`
+	Locals int    `json:"locals"`
+}
+
+// Edge is a call from one function to another. Calls is the number of call sites
+type Edge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Calls int    `json:"calls"`
+}
+
+// CallGraph is a graph of calls between functions of a program
+type CallGraph struct {
+	Nodes []Node `json:"nodes"`
+	Edges []Edge `json:"edges"`
+}
+
+// BuildCallGraph builds the call graph of all files. Nodes keep the order of the
+// definitions, edges are sorted. Calls written outside functions are skipped
+func BuildCallGraph(files []File) *CallGraph {
+	g := &CallGraph{Nodes: []Node{}, Edges: []Edge{}}
+	edges := make(map[[2]string]int)
+	for _, f := range files {
+		fn := ""
+		for _, cmd := range f.Commands {
+			switch cmd.CmdType {
+			case parser.CmdFunction:
+				fn = cmd.Arg1
+				g.Nodes = append(g.Nodes, Node{Name: fn, File: f.Name, Locals: cmd.Arg2})
+			case parser.CmdCall:
+				if fn != "" {
+					edges[[2]string{fn, cmd.Arg1}]++
+				}
+			}
+		}
+	}
+
+	for e, n := range edges {
+		g.Edges = append(g.Edges, Edge{From: e[0], To: e[1], Calls: n})
+	}
+	sort.Slice(g.Edges, func(i, j int) bool {
+		if g.Edges[i].From != g.Edges[j].From {
+			return g.Edges[i].From < g.Edges[j].From
+		}
+		return g.Edges[i].To < g.Edges[j].To
+	})
+	return g
+}
+
+// WriteDOT writes the graph in the Graphviz DOT language
+func (g *CallGraph) WriteDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph calls {")
+	fmt.Fprintln(bw, "\tnode [shape=box];")
+	for _, n := range g.Nodes {
+		label := fmt.Sprintf("%s\n%s, %d locals", n.Name, n.File, n.Locals)
+		fmt.Fprintf(bw, "\t%q [label=%q];\n", n.Name, label)
+	}
+	for _, e := range g.Edges {
+		fmt.Fprintf(bw, "\t%q -> %q [label=\"%d\"];\n", e.From, e.To, e.Calls)
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// WriteJSON writes the graph as a JSON object with nodes and edges
+func (g *CallGraph) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(g)
+}
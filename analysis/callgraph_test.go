@@ -0,0 +1,65 @@
+package analysis
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func testGraph(t *testing.T) *CallGraph {
+	return BuildCallGraph([]File{
+		parseFile(t, "Sys.vm", "function Sys.init 0\ncall Main.f 0\ncall Main.f 0\ncall Math.abs 1\n"),
+		parseFile(t, "Main.vm", "function Main.f 2\ncall Sys.init 0\nreturn\n"),
+	})
+}
+
+func TestCallGraph(t *testing.T) {
+	g := testGraph(t)
+	wantNodes := []Node{{"Sys.init", "Sys.vm", 0}, {"Main.f", "Main.vm", 2}}
+	if len(g.Nodes) != len(wantNodes) {
+		t.Fatalf("Got nodes %+v; want %+v", g.Nodes, wantNodes)
+	}
+	for i, w := range wantNodes {
+		if g.Nodes[i] != w {
+			t.Errorf("Node %v: %+v; want %+v", i, g.Nodes[i], w)
+		}
+	}
+	wantEdges := []Edge{{"Main.f", "Sys.init", 1}, {"Sys.init", "Main.f", 2}, {"Sys.init", "Math.abs", 1}}
+	if len(g.Edges) != len(wantEdges) {
+		t.Fatalf("Got edges %+v; want %+v", g.Edges, wantEdges)
+	}
+	for i, w := range wantEdges {
+		if g.Edges[i] != w {
+			t.Errorf("Edge %v: %+v; want %+v", i, g.Edges[i], w)
+		}
+	}
+}
+
+func TestCallGraphWrite(t *testing.T) {
+	g := testGraph(t)
+	sb := strings.Builder{}
+	if err := g.WriteDOT(&sb); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []string{
+		"digraph calls {",
+		`"Main.f" [label="Main.f\nMain.vm, 2 locals"];`,
+		`"Sys.init" -> "Main.f" [label="2"];`,
+	} {
+		if !strings.Contains(sb.String(), w) {
+			t.Errorf("DOT does not contain %s:\n%s", w, sb.String())
+		}
+	}
+
+	sb.Reset()
+	if err := g.WriteJSON(&sb); err != nil {
+		t.Fatal(err)
+	}
+	var decoded CallGraph
+	if err := json.Unmarshal([]byte(sb.String()), &decoded); err != nil {
+		t.Fatalf("Illegal JSON %v", err)
+	}
+	if len(decoded.Nodes) != 2 || len(decoded.Edges) != 3 || decoded.Edges[1] != g.Edges[1] {
+		t.Errorf("Wrong decoded graph %+v", decoded)
+	}
+}
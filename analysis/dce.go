@@ -0,0 +1,79 @@
+package analysis
+
+import (
+	"github.com/verybigtuple/hackvmtranslator/parser"
+)
+
+// DeadFunction is a function which cannot be called from the roots
+type DeadFunction struct {
+	Name     string
+	File     string
+	Commands []parser.Command
+}
+
+// Reachable returns the functions reachable from the roots. Functions called
+// by the code outside functions are roots as well
+func Reachable(files []File, roots []string) map[string]bool {
+	var queue []string
+	queue = append(queue, roots...)
+	for _, f := range files {
+		for _, cmd := range f.Commands {
+			if cmd.CmdType == parser.CmdFunction {
+				break
+			}
+			if cmd.CmdType == parser.CmdCall {
+				queue = append(queue, cmd.Arg1)
+			}
+		}
+	}
+
+	callees := make(map[string][]string)
+	for _, e := range BuildCallGraph(files).Edges {
+		callees[e.From] = append(callees[e.From], e.To)
+	}
+	live := make(map[string]bool)
+	for len(queue) > 0 {
+		fn := queue[0]
+		queue = queue[1:]
+		if live[fn] {
+			continue
+		}
+		live[fn] = true
+		queue = append(queue, callees[fn]...)
+	}
+	return live
+}
+
+// Eliminate removes the functions which are not reachable from the roots.
+// The code outside functions is always kept
+func Eliminate(files []File, roots []string) ([]File, []DeadFunction) {
+	live := Reachable(files, roots)
+	var dead []DeadFunction
+	result := make([]File, len(files))
+	for i, f := range files {
+		result[i] = File{Name: f.Name}
+		keep := true
+		var cur *DeadFunction
+		for _, cmd := range f.Commands {
+			if cmd.CmdType == parser.CmdFunction {
+				if cur != nil {
+					dead = append(dead, *cur)
+					cur = nil
+				}
+				keep = live[cmd.Arg1]
+				if !keep {
+					cur = &DeadFunction{Name: cmd.Arg1, File: f.Name}
+				}
+			}
+			if keep {
+				result[i].Commands = append(result[i].Commands, cmd)
+			} else {
+				cur.Commands = append(cur.Commands, cmd)
+			}
+		}
+		if cur != nil {
+			dead = append(dead, *cur)
+		}
+	}
+	return result, dead
+}
@@ -0,0 +1,36 @@
+package analysis
+
+import (
+	"testing"
+
+	"github.com/verybigtuple/hackvmtranslator/parser"
+)
+
+func TestEliminate(t *testing.T) {
+	files := []File{
+		parseFile(t, "Main.vm", "call Main.top 0\nfunction Main.top 0\nreturn\nfunction Main.main 0\ncall Main.rec 0\nreturn\n"),
+		parseFile(t, "Lib.vm", "function Main.rec 0\ncall Main.rec 0\nreturn\nfunction Lib.unused 1\ncall Main.main 0\nreturn\n"),
+	}
+	live, dead := Eliminate(files, []string{"Main.main"})
+	if len(dead) != 1 || dead[0].Name != "Lib.unused" || dead[0].File != "Lib.vm" || len(dead[0].Commands) != 3 {
+		t.Errorf("Wrong dead functions %+v", dead)
+	}
+	if len(live) != 2 || len(live[0].Commands) != 6 || len(live[1].Commands) != 3 {
+		t.Errorf("Wrong live files %+v", live)
+	}
+	if cmd := live[1].Commands[2]; cmd.CmdType != parser.CmdReturn {
+		t.Errorf("Wrong last command %+v", cmd)
+	}
+}
+
+func TestReachable(t *testing.T) {
+	files := []File{
+		parseFile(t, "Sys.vm", "function Sys.init 0\ncall A.f 0\nfunction A.f 0\ncall A.g 0\nfunction A.g 0\nfunction B.f 0\n"),
+	}
+	live := Reachable(files, []string{SysInit})
+	for fn, want := range map[string]bool{"Sys.init": true, "A.f": true, "A.g": true, "B.f": false} {
+		if live[fn] != want {
+			t.Errorf("Function %s: reachable %v; want %v", fn, live[fn], want)
+		}
+	}
+}
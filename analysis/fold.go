@@ -0,0 +1,109 @@
+package analysis
+
+import (
+	"github.com/verybigtuple/hackvmtranslator/parser"
+)
+
+// Fold folds arithmetic, logical and compare commands of constants into a single push
+// and removes identities: add, sub and or of 0, and of -1, neg neg and not not.
+// The values are 16-bit, so folded constants may be negative. Such pushes cannot be
+// written in the VM code, but the codewriter supports them.
+// A folded command gets the position of its first command
+func Fold(cmds []parser.Command) []parser.Command {
+	res := make([]parser.Command, 0, len(cmds))
+	for _, cmd := range cmds {
+		res = append(res, cmd)
+		for {
+			n, ok := foldTail(res)
+			if !ok {
+				break
+			}
+			res = n
+		}
+	}
+	return res
+}
+
+// FoldFiles folds the commands of every file
+func FoldFiles(files []File) []File {
+	res := make([]File, len(files))
+	for i, f := range files {
+		res[i] = File{Name: f.Name, Commands: Fold(f.Commands)}
+	}
+	return res
+}
+
+// constValue returns the value of a push constant command
+func constValue(cmd parser.Command) (int16, bool) {
+	if cmd.CmdType != parser.CmdPush || !parser.IsConstantSegment(cmd.Arg1) {
+		return 0, false
+	}
+	return int16(cmd.Arg2), true
+}
+
+func pushConst(v int16, pos parser.Pos) parser.Command {
+	return parser.Command{CmdType: parser.CmdPush, Arg1: parser.ConstantKey, Arg2: int(v), Pos: pos}
+}
+
+func boolValue(b bool) int16 {
+	if b {
+		return -1
+	}
+	return 0
+}
+
+var binaryOps = map[string]func(x, y int16) int16{
+	parser.AddKey: func(x, y int16) int16 { return x + y },
+	parser.SubKey: func(x, y int16) int16 { return x - y },
+	parser.AndKey: func(x, y int16) int16 { return x & y },
+	parser.OrKey:  func(x, y int16) int16 { return x | y },
+	parser.EqKey:  func(x, y int16) int16 { return boolValue(x == y) },
+	parser.GtKey:  func(x, y int16) int16 { return boolValue(x > y) },
+	parser.LtKey:  func(x, y int16) int16 { return boolValue(x < y) },
+}
+
+var unaryOps = map[string]func(x int16) int16{
+	parser.NegKey: func(x int16) int16 { return -x },
+	parser.NotKey: func(x int16) int16 { return ^x },
+}
+
+// identities are the binary commands which do not change x if y is the constant
+var identities = map[string]int16{
+	parser.AddKey: 0,
+	parser.SubKey: 0,
+	parser.OrKey:  0,
+	parser.AndKey: -1,
+}
+
+// foldTail folds the last commands if it is possible
+func foldTail(cmds []parser.Command) ([]parser.Command, bool) {
+	n := len(cmds)
+	if n < 2 {
+		return cmds, false
+	}
+	last, prev := cmds[n-1], cmds[n-2]
+	switch last.CmdType {
+	case parser.CmdArithmeticBinary, parser.CmdArithmeticCond:
+		y, ok := constValue(prev)
+		if !ok {
+			return cmds, false
+		}
+		if n >= 3 {
+			if x, ok := constValue(cmds[n-3]); ok {
+				v := binaryOps[last.Arg1](x, y)
+				return append(cmds[:n-3], pushConst(v, cmds[n-3].Pos)), true
+			}
+		}
+		if id, ok := identities[last.Arg1]; ok && y == id {
+			return cmds[:n-2], true
+		}
+	case parser.CmdArithmeticUnary:
+		if x, ok := constValue(prev); ok {
+			return append(cmds[:n-2], pushConst(unaryOps[last.Arg1](x), prev.Pos)), true
+		}
+		if prev.CmdType == parser.CmdArithmeticUnary && prev.Arg1 == last.Arg1 {
+			return cmds[:n-2], true
+		}
+	}
+	return cmds, false
+}
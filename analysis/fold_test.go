@@ -0,0 +1,84 @@
+package analysis
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/verybigtuple/hackvmtranslator/parser"
+)
+
+// cmdsText formats commands like the VM code, one command per line
+func cmdsText(cmds []parser.Command) string {
+	lines := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		switch cmd.CmdType {
+		case parser.CmdPush:
+			lines[i] = fmt.Sprintf("push %s %d", cmd.Arg1, cmd.Arg2)
+		case parser.CmdPop:
+			lines[i] = fmt.Sprintf("pop %s %d", cmd.Arg1, cmd.Arg2)
+		case parser.CmdLabel:
+			lines[i] = "label " + cmd.Arg1
+		case parser.CmdGoto:
+			lines[i] = "goto " + cmd.Arg1
+		case parser.CmdIfGoto:
+			lines[i] = "if-goto " + cmd.Arg1
+		case parser.CmdFunction:
+			lines[i] = fmt.Sprintf("function %s %d", cmd.Arg1, cmd.Arg2)
+		case parser.CmdCall:
+			lines[i] = fmt.Sprintf("call %s %d", cmd.Arg1, cmd.Arg2)
+		case parser.CmdReturn:
+			lines[i] = "return"
+		default:
+			lines[i] = cmd.Arg1
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestFold(t *testing.T) {
+	testCases := []struct {
+		desc string
+		src  string
+		want string
+	}{
+		{"Add", "push constant 2\npush constant 3\nadd", "push constant 5"},
+		{"True", "push constant 0\nnot", "push constant -1"},
+		{"Neg", "push constant 7\nneg", "push constant -7"},
+		{"Overflow", "push constant 32767\npush constant 1\nadd", "push constant -32768"},
+		{"Nested", "push constant 2\npush constant 3\npush constant 4\nadd\nsub\nneg", "push constant 5"},
+		{"Compare", "push constant 1\npush constant 0\nnot\ngt", "push constant -1"},
+		{"Signed compare", "push constant 0\nnot\npush constant 1\nlt", "push constant -1"},
+		{"And or", "push constant 12\npush constant 10\nand\npush constant 1\nor", "push constant 9"},
+		{"Add zero", "push local 0\npush constant 0\nadd\npop local 1", "push local 0\npop local 1"},
+		{"And true", "push local 0\npush constant 0\nnot\nand", "push local 0"},
+		{"Neg neg", "push local 0\nneg\nneg\nnot\nnot", "push local 0"},
+		{"Not neg", "push local 0\nnot\nneg", "push local 0\nnot\nneg"},
+		{"Zero minus", "push constant 0\npush local 0\nsub", "push constant 0\npush local 0\nsub"},
+		{
+			"Label between",
+			"push constant 1\nlabel L\npush constant 2\nadd",
+			"push constant 1\nlabel L\npush constant 2\nadd",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			f := parseFile(t, "Main.vm", tc.src)
+			actual := cmdsText(Fold(f.Commands))
+			if actual != tc.want {
+				t.Errorf("Actual:\n%s\nwant:\n%s", actual, tc.want)
+			}
+		})
+	}
+}
+
+func TestFoldPos(t *testing.T) {
+	f := parseFile(t, "Main.vm", "push local 0\npush constant 2\npush constant 3\nadd\n")
+	cmds := Fold(f.Commands)
+	if len(cmds) != 2 || cmds[1].Pos.Line != 2 {
+		t.Errorf("Wrong folded commands %+v", cmds)
+	}
+	if len(f.Commands) != 4 {
+		t.Errorf("Source commands are changed %+v", f.Commands)
+	}
+}
@@ -0,0 +1,240 @@
+package analysis
+
+import (
+	"fmt"
+
+	"github.com/verybigtuple/hackvmtranslator/parser"
+)
+
+// Inlined is a function substituted at its call sites
+type Inlined struct {
+	Name     string `json:"name"`
+	File     string `json:"file"`
+	Commands int    `json:"commands"` // Number of commands of the body
+	Sites    int    `json:"sites"`    // Number of inlined calls
+}
+
+// inlineCandidate is a leaf function which can be inlined
+type inlineCandidate struct {
+	name    string
+	file    string
+	locals  int
+	body    []parser.Command // Commands after the function command
+	maxArg  int              // Max index of the argument segment or -1
+	statics bool             // The body accesses the static segment of its file
+}
+
+// Inline substitutes the bodies of leaf functions which have at most maxCommands commands
+// at their call sites. The args and locals of an inlined function become new locals of
+// the caller. The function is a leaf if it does not call functions. It is inlined only if
+// it ends with return and every return leaves exactly one value on its working stack.
+// Its args must be passed by every inlined call and its locals must be declared.
+// The this, that and temp segments are shared with the caller anyway, so they may be read
+// and written, and pointer may be read. Pop pointer is not allowed, as an ordinary return
+// restores THIS and THAT of the caller, but the inlined code would leave them changed.
+// Statics belong to the file of the function, so such a function is inlined only in its file.
+// Calls written outside functions are kept. The inlined functions stay in the files, the dead
+// function elimination drops them if they are not called anymore
+func Inline(files []File, maxCommands int) ([]File, []Inlined) {
+	candidates := make(map[string]*inlineCandidate)
+	for _, f := range files {
+		start := -1
+		for i := 0; i <= len(f.Commands); i++ {
+			if i < len(f.Commands) && f.Commands[i].CmdType != parser.CmdFunction {
+				continue
+			}
+			if start >= 0 {
+				if c := newInlineCandidate(f, start, i, maxCommands); c != nil {
+					candidates[c.name] = c
+				}
+			}
+			start = i
+		}
+	}
+
+	var report []Inlined
+	reported := make(map[string]int) // Index in the report
+	sites := make(map[string]int)
+	res := make([]File, len(files))
+	for fi, f := range files {
+		res[fi] = File{Name: f.Name}
+		cmds := make([]parser.Command, 0, len(f.Commands))
+		fnIdx, locals, extra := -1, 0, 0
+		var labels map[string]bool // Labels of the caller including the inlined ones
+		closeFunc := func() {
+			if fnIdx >= 0 {
+				cmds[fnIdx].Arg2 = locals + extra
+			}
+		}
+		for i, cmd := range f.Commands {
+			if cmd.CmdType == parser.CmdFunction {
+				closeFunc()
+				fnIdx, locals, extra = len(cmds), cmd.Arg2, 0
+				labels = functionLabels(f.Commands[i+1:])
+			}
+			c := candidates[cmd.Arg1]
+			if cmd.CmdType != parser.CmdCall || fnIdx < 0 || c == nil || !c.fits(cmd.Arg2, f.Name) {
+				cmds = append(cmds, cmd)
+				continue
+			}
+			var prefix string
+			prefix, sites[c.name] = c.labelPrefix(labels, sites[c.name])
+			for _, ic := range c.expand(cmd, locals, prefix) {
+				if ic.CmdType == parser.CmdLabel {
+					labels[ic.Arg1] = true
+				}
+				cmds = append(cmds, ic)
+			}
+			if cmd.Arg2+c.locals > extra {
+				extra = cmd.Arg2 + c.locals
+			}
+			idx, ok := reported[c.name]
+			if !ok {
+				idx = len(report)
+				reported[c.name] = idx
+				report = append(report, Inlined{Name: c.name, File: c.file, Commands: len(c.body)})
+			}
+			report[idx].Sites++
+		}
+		closeFunc()
+		res[fi].Commands = cmds
+	}
+	return res, report
+}
+
+// newInlineCandidate returns the function in Commands[start:end] if it can be inlined
+func newInlineCandidate(f File, start, end, maxCommands int) *inlineCandidate {
+	fn := f.Commands[start]
+	c := &inlineCandidate{
+		name:   fn.Arg1,
+		file:   f.Name,
+		locals: fn.Arg2,
+		body:   f.Commands[start+1 : end],
+		maxArg: -1,
+	}
+	if len(c.body) == 0 || len(c.body) > maxCommands || c.body[len(c.body)-1].CmdType != parser.CmdReturn {
+		return nil
+	}
+	for _, cmd := range c.body {
+		switch cmd.CmdType {
+		case parser.CmdCall:
+			return nil
+		case parser.CmdPush, parser.CmdPop:
+			switch {
+			case cmd.Arg1 == parser.ArgumentKey && cmd.Arg2 > c.maxArg:
+				c.maxArg = cmd.Arg2
+			case cmd.Arg1 == parser.LocalKey && cmd.Arg2 >= c.locals:
+				return nil
+			case cmd.CmdType == parser.CmdPop && parser.IsPointerSegment(cmd.Arg1):
+				return nil
+			case parser.IsStaticSegment(cmd.Arg1):
+				c.statics = true
+			}
+		}
+	}
+	if !returnsOneValue(f, start, end) {
+		return nil
+	}
+	return c
+}
+
+// returnsOneValue reports if every reachable return of the function in Commands[start:end]
+// leaves exactly one value on its working stack and the function never reads below the stack
+func returnsOneValue(f File, start, end int) bool {
+	fs, diags := stackFunction(f, start, end)
+	if len(diags) > 0 {
+		return false
+	}
+	for _, b := range fs.Blocks {
+		if b.Entry < 0 {
+			continue
+		}
+		height := b.Entry
+		for _, cmd := range f.Commands[b.Start:b.End] {
+			if cmd.CmdType == parser.CmdReturn && height != 1 {
+				return false
+			}
+			_, effect := stackEffect(cmd)
+			height += effect
+		}
+	}
+	return true
+}
+
+// functionLabels returns the labels of the function whose body starts at cmds[0]
+func functionLabels(cmds []parser.Command) map[string]bool {
+	labels := make(map[string]bool)
+	for _, cmd := range cmds {
+		if cmd.CmdType == parser.CmdFunction {
+			break
+		}
+		if cmd.CmdType == parser.CmdLabel {
+			labels[cmd.Arg1] = true
+		}
+	}
+	return labels
+}
+
+// labelPrefix returns the prefix of the labels of an expansion and the next site number.
+// VM labels may contain dots, so the site number is increased until the end label and
+// the renamed labels of the body do not collide with the labels of the caller
+func (c *inlineCandidate) labelPrefix(labels map[string]bool, site int) (string, int) {
+	for ; ; site++ {
+		prefix := fmt.Sprintf("%s.%d", c.name, site)
+		free := !labels[prefix]
+		for _, b := range c.body {
+			if b.CmdType == parser.CmdLabel && labels[prefix+"."+b.Arg1] {
+				free = false
+			}
+		}
+		if free {
+			return prefix, site + 1
+		}
+	}
+}
+
+// fits reports if a call with the args from the file can be inlined
+func (c *inlineCandidate) fits(args int, file string) bool {
+	return c.maxArg < args && (!c.statics || file == c.file)
+}
+
+// expand returns the commands substituting the call. The args and locals of the candidate
+// are moved to the locals of the caller from the index base. The end label is the prefix,
+// the labels of the body are renamed to prefix.label
+func (c *inlineCandidate) expand(call parser.Command, base int, endLabel string) []parser.Command {
+	args := call.Arg2
+	cmd := func(ct parser.CommandType, arg1 string, arg2 int) parser.Command {
+		return parser.Command{CmdType: ct, Arg1: arg1, Arg2: arg2, Pos: call.Pos}
+	}
+
+	res := make([]parser.Command, 0, args+2*c.locals+len(c.body)+1)
+	for i := args - 1; i >= 0; i-- {
+		res = append(res, cmd(parser.CmdPop, parser.LocalKey, base+i))
+	}
+	for j := 0; j < c.locals; j++ {
+		res = append(res, cmd(parser.CmdPush, parser.ConstantKey, 0))
+		res = append(res, cmd(parser.CmdPop, parser.LocalKey, base+args+j))
+	}
+	needEnd := false
+	for i, b := range c.body {
+		switch {
+		case b.CmdType == parser.CmdReturn:
+			if i < len(c.body)-1 {
+				res = append(res, cmd(parser.CmdGoto, endLabel, 0))
+				needEnd = true
+			}
+		case b.CmdType == parser.CmdLabel || b.CmdType == parser.CmdGoto || b.CmdType == parser.CmdIfGoto:
+			res = append(res, cmd(b.CmdType, endLabel+"."+b.Arg1, 0))
+		case (b.CmdType == parser.CmdPush || b.CmdType == parser.CmdPop) && b.Arg1 == parser.ArgumentKey:
+			res = append(res, cmd(b.CmdType, parser.LocalKey, base+b.Arg2))
+		case (b.CmdType == parser.CmdPush || b.CmdType == parser.CmdPop) && b.Arg1 == parser.LocalKey:
+			res = append(res, cmd(b.CmdType, parser.LocalKey, base+args+b.Arg2))
+		default:
+			res = append(res, cmd(b.CmdType, b.Arg1, b.Arg2))
+		}
+	}
+	if needEnd {
+		res = append(res, cmd(parser.CmdLabel, endLabel, 0))
+	}
+	return res
+}
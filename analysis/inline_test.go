@@ -0,0 +1,105 @@
+package analysis
+
+import (
+	"testing"
+)
+
+func TestInline(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		callee string
+		caller string
+		want   string
+	}{
+		{
+			"Args and locals",
+			"function Main.f 1\npush argument 0\npush argument 1\nadd\npop local 0\npush local 0\nreturn\n",
+			"function Main.main 1\npush constant 2\npush constant 3\ncall Main.f 2\npop local 0\npush constant 0\nreturn\n",
+			"function Main.main 4\npush constant 2\npush constant 3\n" +
+				"pop local 2\npop local 1\npush constant 0\npop local 3\n" +
+				"push local 1\npush local 2\nadd\npop local 3\npush local 3\n" +
+				"pop local 0\npush constant 0\nreturn",
+		},
+		{
+			"Several returns",
+			"function Main.f 0\npush argument 0\nif-goto NEG\npush constant 1\nreturn\nlabel NEG\npush constant 0\nreturn\n",
+			"function Main.main 0\npush constant 5\ncall Main.f 1\nreturn\n",
+			"function Main.main 1\npush constant 5\npop local 0\npush local 0\n" +
+				"if-goto Main.f.0.NEG\npush constant 1\ngoto Main.f.0\n" +
+				"label Main.f.0.NEG\npush constant 0\nlabel Main.f.0\nreturn",
+		},
+		{
+			"Label collision",
+			"function Main.f 0\npush argument 0\nif-goto NEG\npush constant 1\nreturn\nlabel NEG\npush constant 0\nreturn\n",
+			"function Main.main 0\nlabel Main.f.0\npush constant 5\ncall Main.f 1\nlabel Main.f.1.NEG\nreturn\n",
+			"function Main.main 1\nlabel Main.f.0\npush constant 5\npop local 0\npush local 0\n" +
+				"if-goto Main.f.2.NEG\npush constant 1\ngoto Main.f.2\n" +
+				"label Main.f.2.NEG\npush constant 0\nlabel Main.f.2\nlabel Main.f.1.NEG\nreturn",
+		},
+		{
+			"Not leaf",
+			"function Main.f 0\ncall Main.g 0\nreturn\n",
+			"function Main.main 0\ncall Main.f 0\nreturn\n",
+			"function Main.main 0\ncall Main.f 0\nreturn",
+		},
+		{
+			"Too large",
+			"function Main.f 0\npush constant 1\nneg\nneg\nneg\nneg\nneg\nneg\nneg\nneg\nneg\nreturn\n",
+			"function Main.main 0\ncall Main.f 0\nreturn\n",
+			"function Main.main 0\ncall Main.f 0\nreturn",
+		},
+		{
+			"Pop pointer",
+			"function Main.f 0\npush argument 0\npop pointer 0\npush this 0\nreturn\n",
+			"function Main.main 0\npush constant 3000\ncall Main.f 1\nreturn\n",
+			"function Main.main 0\npush constant 3000\ncall Main.f 1\nreturn",
+		},
+		{
+			"Too few args",
+			"function Main.f 0\npush argument 1\nreturn\n",
+			"function Main.main 0\npush constant 1\ncall Main.f 1\nreturn\n",
+			"function Main.main 0\npush constant 1\ncall Main.f 1\nreturn",
+		},
+		{
+			"Extra values on return",
+			"function Main.f 0\npush constant 1\npush constant 2\nreturn\n",
+			"function Main.main 0\ncall Main.f 0\nreturn\n",
+			"function Main.main 0\ncall Main.f 0\nreturn",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			files := []File{parseFile(t, "Main.vm", tc.caller), parseFile(t, "Lib.vm", tc.callee)}
+			res, _ := Inline(files, 10)
+			actual := cmdsText(res[0].Commands)
+			if actual != tc.want {
+				t.Errorf("Actual:\n%s\nwant:\n%s", actual, tc.want)
+			}
+		})
+	}
+}
+
+func TestInlineReport(t *testing.T) {
+	files := []File{
+		parseFile(t, "Main.vm", "function Main.main 0\ncall Lib.one 0\ncall Lib.one 0\nadd\ncall Lib.st 0\nreturn\n"),
+		parseFile(t, "Lib.vm", "function Lib.one 0\npush constant 1\nreturn\nfunction Lib.st 0\npush static 0\nreturn\n"+
+			"function Lib.main 0\ncall Lib.st 0\nreturn\n"),
+	}
+	res, report := Inline(files, 10)
+	want := []Inlined{{"Lib.one", "Lib.vm", 2, 2}, {"Lib.st", "Lib.vm", 2, 1}}
+	if len(report) != len(want) {
+		t.Fatalf("Actual %+v; want %+v", report, want)
+	}
+	for i := range want {
+		if report[i] != want[i] {
+			t.Errorf("Actual %+v; want %+v", report[i], want[i])
+		}
+	}
+	// Statics belong to the file, so Lib.st is kept in Main.vm
+	if actual := cmdsText(res[0].Commands); actual != "function Main.main 0\npush constant 1\npush constant 1\nadd\ncall Lib.st 0\nreturn" {
+		t.Errorf("Wrong Main.vm:\n%s", actual)
+	}
+	if len(files[0].Commands) != 6 {
+		t.Errorf("Source commands are changed %+v", files[0].Commands)
+	}
+}
@@ -0,0 +1,140 @@
+// Package analysis checks parsed VM programs as a whole
+package analysis
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/verybigtuple/hackvmtranslator/parser"
+)
+
+// File is a parsed VM file
+type File struct {
+	Name     string
+	Commands []parser.Command
+}
+
+// Codes of the link diagnostics
+const (
+	CodeUndefinedFunction parser.Code = "VM101"
+	CodeDuplicateFunction parser.Code = "VM102"
+	CodeUndefinedLabel    parser.Code = "VM103"
+	CodeDuplicateLabel    parser.Code = "VM104"
+	CodeNoSysInit         parser.Code = "VM105"
+	CodeUndefinedRoot     parser.Code = "VM106"
+	CodeTooManyStatics    parser.Code = "VM107"
+)
+
+// SysInit is the function called by the bootstrapping code
+const SysInit = parser.SysInit
+
+// LinkOptions are options of Link
+type LinkOptions struct {
+	Bootstrap bool     // The bootstrapping code calls Sys.init, so it must be defined
+	Roots     []string // Functions which must be defined, e.g. roots of the dead function elimination
+	// StaticLimit is a number of static vars of all files. No limit if 0
+	StaticLimit int
+}
+
+// Link checks that every call targets a function defined in one of the files and
+// every goto and if-goto targets a label of the same function. Labels written before
+// the first function of a file share one scope across all files like in the asm code.
+// Static vars of all files share RAM, so their total number is checked against StaticLimit
+func Link(files []File, opts LinkOptions) []*parser.Diagnostic {
+	var diags []*parser.Diagnostic
+	funcs := make(map[string]parser.Pos)
+	labels := make(map[string]parser.Pos) // Key is function$label
+	statics := make(map[string]bool)      // Key is file.index
+
+	for _, f := range files {
+		fn := ""
+		for _, cmd := range f.Commands {
+			switch cmd.CmdType {
+			case parser.CmdFunction:
+				fn = cmd.Arg1
+				if prev, ok := funcs[fn]; ok {
+					diags = append(diags, linkError(CodeDuplicateFunction, cmd.Pos,
+						"Function %s is already defined at %v", fn, prev))
+					continue
+				}
+				funcs[fn] = cmd.Pos
+			case parser.CmdLabel:
+				key := fn + "$" + cmd.Arg1
+				if prev, ok := labels[key]; ok {
+					diags = append(diags, linkError(CodeDuplicateLabel, cmd.Pos,
+						"Label %s is already defined at %v", cmd.Arg1, prev))
+					continue
+				}
+				labels[key] = cmd.Pos
+			}
+		}
+	}
+
+	for _, f := range files {
+		fn := ""
+		for _, cmd := range f.Commands {
+			switch cmd.CmdType {
+			case parser.CmdFunction:
+				fn = cmd.Arg1
+			case parser.CmdGoto, parser.CmdIfGoto:
+				if _, ok := labels[fn+"$"+cmd.Arg1]; !ok {
+					diags = append(diags, linkError(CodeUndefinedLabel, cmd.Pos,
+						"Undefined label %s in %s", cmd.Arg1, scopeName(fn)))
+				}
+			case parser.CmdCall:
+				if _, ok := funcs[cmd.Arg1]; !ok {
+					diags = append(diags, linkError(CodeUndefinedFunction, cmd.Pos,
+						"Undefined function %s", cmd.Arg1))
+				}
+			case parser.CmdPush, parser.CmdPop:
+				if !parser.IsStaticSegment(cmd.Arg1) {
+					continue
+				}
+				key := fmt.Sprintf("%s.%d", f.Name, cmd.Arg2)
+				if statics[key] {
+					continue
+				}
+				statics[key] = true
+				if opts.StaticLimit > 0 && len(statics) == opts.StaticLimit+1 {
+					diags = append(diags, linkError(CodeTooManyStatics, cmd.Pos,
+						"Static vars of all files exceed the limit %d", opts.StaticLimit))
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(diags, func(i, j int) bool {
+		if diags[i].Pos.File != diags[j].Pos.File {
+			return diags[i].Pos.File < diags[j].Pos.File
+		}
+		return diags[i].Pos.Line < diags[j].Pos.Line
+	})
+
+	if _, ok := funcs[SysInit]; opts.Bootstrap && !ok {
+		diags = append(diags, linkError(CodeNoSysInit, parser.Pos{},
+			"Function %s is not defined, but the bootstrapping code calls it", SysInit))
+	}
+	for _, root := range opts.Roots {
+		if _, ok := funcs[root]; !ok {
+			diags = append(diags, linkError(CodeUndefinedRoot, parser.Pos{},
+				"Root function %s is not defined", root))
+		}
+	}
+	return diags
+}
+
+func scopeName(fn string) string {
+	if fn == "" {
+		return "the code outside functions"
+	}
+	return "function " + fn
+}
+
+func linkError(code parser.Code, pos parser.Pos, format string, a ...interface{}) *parser.Diagnostic {
+	return &parser.Diagnostic{
+		Severity: parser.SeverityError,
+		Code:     code,
+		Pos:      pos,
+		Msg:      fmt.Sprintf(format, a...),
+	}
+}
@@ -0,0 +1,81 @@
+package analysis
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/verybigtuple/hackvmtranslator/parser"
+)
+
+func parseFile(t *testing.T, name, src string) File {
+	t.Helper()
+	p := parser.NewParserFile(bufio.NewReader(strings.NewReader(src)), name)
+	cmds, errs := p.ParseAll()
+	if len(errs) > 0 {
+		t.Fatalf("Unexpected parse errors %v", errs)
+	}
+	return File{Name: name, Commands: cmds}
+}
+
+func TestLinkOK(t *testing.T) {
+	files := []File{
+		parseFile(t, "Sys.vm", "function Sys.init 0\ncall Main.f 0\nlabel LOOP\ngoto LOOP\n"),
+		parseFile(t, "Main.vm", "function Main.f 0\nlabel LOOP\nif-goto LOOP\nreturn\n"),
+	}
+	if diags := Link(files, LinkOptions{Bootstrap: true}); len(diags) > 0 {
+		t.Errorf("Unexpected diagnostics %v", diags)
+	}
+}
+
+func TestLinkLabelScopes(t *testing.T) {
+	files := []File{
+		parseFile(t, "A.vm", "label TOP\nfunction A.f 0\ngoto TOP\nlabel X\nfunction A.g 0\ngoto X\n"),
+		parseFile(t, "B.vm", "goto TOP\nlabel TOP\n"),
+	}
+	diags := Link(files, LinkOptions{})
+	want := []struct {
+		file string
+		line int
+		code parser.Code
+	}{
+		{"A.vm", 3, CodeUndefinedLabel},
+		{"A.vm", 6, CodeUndefinedLabel},
+		{"B.vm", 2, CodeDuplicateLabel},
+	}
+	if len(diags) != len(want) {
+		t.Fatalf("Got diagnostics %v; want %v of them", diags, len(want))
+	}
+	for i, w := range want {
+		d := diags[i]
+		if d.Pos.File != w.file || d.Pos.Line != w.line || d.Code != w.code {
+			t.Errorf("Diagnostic %v: %v; want %s:%d %s", i, d, w.file, w.line, w.code)
+		}
+	}
+}
+
+func TestLinkSysInit(t *testing.T) {
+	files := []File{parseFile(t, "Main.vm", "function Main.f 0\nreturn\n")}
+	diags := Link(files, LinkOptions{Bootstrap: true})
+	if len(diags) != 1 || diags[0].Code != CodeNoSysInit {
+		t.Errorf("Got %v; want the missing Sys.init", diags)
+	}
+	if diags := Link(files, LinkOptions{}); len(diags) > 0 {
+		t.Errorf("Unexpected diagnostics %v without bootstrap", diags)
+	}
+}
+
+func TestLinkStaticLimit(t *testing.T) {
+	// Every file fits the limit, but the statics of both files do not
+	files := []File{
+		parseFile(t, "Main.vm", "push static 0\npush static 1\npop static 0\n"),
+		parseFile(t, "Lib.vm", "push static 0\npush static 1\n"),
+	}
+	diags := Link(files, LinkOptions{StaticLimit: 3})
+	if len(diags) != 1 || diags[0].Code != CodeTooManyStatics || diags[0].Pos.File != "Lib.vm" || diags[0].Pos.Line != 2 {
+		t.Errorf("Got %v; want too many statics at Lib.vm:2", diags)
+	}
+	if diags := Link(files, LinkOptions{StaticLimit: 4}); len(diags) > 0 {
+		t.Errorf("Unexpected diagnostics %v", diags)
+	}
+}
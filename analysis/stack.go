@@ -0,0 +1,177 @@
+package analysis
+
+import (
+	"fmt"
+
+	"github.com/verybigtuple/hackvmtranslator/parser"
+)
+
+// Codes of the stack diagnostics
+const (
+	CodeStackUnderflow  parser.Code = "VM201"
+	CodeReturnEmpty     parser.Code = "VM202"
+	CodeHeightsMismatch parser.Code = "VM203"
+)
+
+// Block is a basic block of a function. Start and End are indices of the commands
+// of the file: the block is Commands[Start:End]
+type Block struct {
+	Start, End int
+	Effect     int // Change of the stack height
+	Need       int // Minimal stack height on entry to avoid an underflow
+	Peak       int // Maximal stack height relative to the entry height
+	Entry      int // Stack height on entry or -1 if the block is unreachable
+}
+
+// FunctionStack is the stack analysis of a function
+type FunctionStack struct {
+	Name     string
+	File     string
+	MaxDepth int // Worst-case depth of the working stack of the function
+	Blocks   []Block
+}
+
+// Stack computes the stack effect of every basic block of every function and the
+// worst-case depth of the working stacks. Underflows, returns with an empty stack and
+// different heights of paths merging at a label are reported as warnings.
+// Commands before the first function of a file are not analyzed
+func Stack(files []File) ([]FunctionStack, []*parser.Diagnostic) {
+	var funcs []FunctionStack
+	var diags []*parser.Diagnostic
+	for _, f := range files {
+		start := -1
+		for i, cmd := range f.Commands {
+			if cmd.CmdType != parser.CmdFunction {
+				continue
+			}
+			if start >= 0 {
+				fs, ds := stackFunction(f, start, i)
+				funcs, diags = append(funcs, fs), append(diags, ds...)
+			}
+			start = i
+		}
+		if start >= 0 {
+			fs, ds := stackFunction(f, start, len(f.Commands))
+			funcs, diags = append(funcs, fs), append(diags, ds...)
+		}
+	}
+	return funcs, diags
+}
+
+// stackEffect returns the stack height a command needs and the change of the height
+func stackEffect(cmd parser.Command) (need, effect int) {
+	switch cmd.CmdType {
+	case parser.CmdPush:
+		return 0, 1
+	case parser.CmdPop, parser.CmdIfGoto:
+		return 1, -1
+	case parser.CmdArithmeticBinary, parser.CmdArithmeticCond:
+		return 2, -1
+	case parser.CmdArithmeticUnary, parser.CmdReturn:
+		return 1, 0
+	case parser.CmdCall:
+		return cmd.Arg2, 1 - cmd.Arg2
+	}
+	return 0, 0
+}
+
+func endsBlock(ct parser.CommandType) bool {
+	return ct == parser.CmdGoto || ct == parser.CmdIfGoto || ct == parser.CmdReturn
+}
+
+// stackFunction analyzes the function in Commands[start:end]
+func stackFunction(f File, start, end int) (FunctionStack, []*parser.Diagnostic) {
+	cmds := f.Commands
+	fs := FunctionStack{Name: cmds[start].Arg1, File: f.Name}
+
+	labels := make(map[string]int) // Label to the block index
+	for i := start; i < end; i++ {
+		if i == start || cmds[i].CmdType == parser.CmdLabel || endsBlock(cmds[i-1].CmdType) {
+			if len(fs.Blocks) > 0 {
+				fs.Blocks[len(fs.Blocks)-1].End = i
+			}
+			fs.Blocks = append(fs.Blocks, Block{Start: i, Entry: -1})
+		}
+		if cmds[i].CmdType == parser.CmdLabel {
+			labels[cmds[i].Arg1] = len(fs.Blocks) - 1
+		}
+	}
+	fs.Blocks[len(fs.Blocks)-1].End = end
+
+	for bi := range fs.Blocks {
+		b := &fs.Blocks[bi]
+		for _, cmd := range cmds[b.Start:b.End] {
+			need, effect := stackEffect(cmd)
+			if need-b.Effect > b.Need {
+				b.Need = need - b.Effect
+			}
+			b.Effect += effect
+			if b.Effect > b.Peak {
+				b.Peak = b.Effect
+			}
+		}
+	}
+
+	var diags []*parser.Diagnostic
+	mismatched := make(map[int]bool)
+	enter := func(bi, height int, from parser.Command) []int {
+		b := &fs.Blocks[bi]
+		if b.Entry < 0 {
+			b.Entry = height
+			return []int{bi}
+		}
+		if b.Entry != height && !mismatched[bi] {
+			mismatched[bi] = true
+			diags = append(diags, stackWarning(CodeHeightsMismatch, cmds[b.Start].Pos,
+				"Stack height is %d on one path and %d on the path from line %d",
+				b.Entry, height, from.Pos.Line))
+		}
+		return nil
+	}
+
+	queue := enter(0, 0, cmds[start])
+	for len(queue) > 0 {
+		bi := queue[0]
+		queue = queue[1:]
+		b := fs.Blocks[bi]
+
+		height := b.Entry
+		for _, cmd := range cmds[b.Start:b.End] {
+			need, effect := stackEffect(cmd)
+			if cmd.CmdType == parser.CmdReturn && height == 0 {
+				diags = append(diags, stackWarning(CodeReturnEmpty, cmd.Pos,
+					"Return with an empty stack in %s", fs.Name))
+				height = need
+			} else if height < need {
+				diags = append(diags, stackWarning(CodeStackUnderflow, cmd.Pos,
+					"Stack underflow in %s: the command needs %d values, but the stack has %d",
+					fs.Name, need, height))
+				height = need
+			}
+			height += effect
+			if height > fs.MaxDepth {
+				fs.MaxDepth = height
+			}
+		}
+
+		last := cmds[b.End-1]
+		if last.CmdType == parser.CmdGoto || last.CmdType == parser.CmdIfGoto {
+			if target, ok := labels[last.Arg1]; ok {
+				queue = append(queue, enter(target, height, last)...)
+			}
+		}
+		if last.CmdType != parser.CmdGoto && last.CmdType != parser.CmdReturn && bi+1 < len(fs.Blocks) {
+			queue = append(queue, enter(bi+1, height, last)...)
+		}
+	}
+	return fs, diags
+}
+
+func stackWarning(code parser.Code, pos parser.Pos, format string, a ...interface{}) *parser.Diagnostic {
+	return &parser.Diagnostic{
+		Severity: parser.SeverityWarning,
+		Code:     code,
+		Pos:      pos,
+		Msg:      fmt.Sprintf(format, a...),
+	}
+}
@@ -0,0 +1,78 @@
+package analysis
+
+import (
+	"testing"
+
+	"github.com/verybigtuple/hackvmtranslator/parser"
+)
+
+func TestStackDepth(t *testing.T) {
+	src := `function Main.f 1
+push argument 0
+push constant 1
+gt
+if-goto BIG
+push constant 1
+push constant 2
+push constant 3
+call Main.g 3
+return
+label BIG
+push local 0
+return
+function Main.g 3
+push argument 0
+return
+`
+	funcs, diags := Stack([]File{parseFile(t, "Main.vm", src)})
+	if len(diags) > 0 {
+		t.Errorf("Unexpected diagnostics %v", diags)
+	}
+	if len(funcs) != 2 {
+		t.Fatalf("Got %v functions; want 2", len(funcs))
+	}
+	if f := funcs[0]; f.Name != "Main.f" || f.MaxDepth != 3 || len(f.Blocks) != 3 {
+		t.Errorf("Wrong analysis of Main.f %+v", f)
+	}
+	b := funcs[0].Blocks[1]
+	if b.Entry != 0 || b.Effect != 1 || b.Need != 0 || b.Peak != 3 {
+		t.Errorf("Wrong second block %+v", b)
+	}
+	if f := funcs[1]; f.Name != "Main.g" || f.MaxDepth != 1 {
+		t.Errorf("Wrong analysis of Main.g %+v", f)
+	}
+}
+
+func TestStackWarnings(t *testing.T) {
+	src := `function Main.f 0
+push constant 1
+add
+label LOOP
+push constant 0
+if-goto END
+push constant 5
+goto LOOP
+label END
+return
+function Main.g 0
+return
+`
+	_, diags := Stack([]File{parseFile(t, "Main.vm", src)})
+	want := []struct {
+		line int
+		code parser.Code
+	}{
+		{3, CodeStackUnderflow},
+		{4, CodeHeightsMismatch},
+		{12, CodeReturnEmpty},
+	}
+	if len(diags) != len(want) {
+		t.Fatalf("Got diagnostics %v; want %v of them", diags, len(want))
+	}
+	for i, w := range want {
+		d := diags[i]
+		if d.Pos.Line != w.line || d.Code != w.code || d.Severity != parser.SeverityWarning {
+			t.Errorf("Diagnostic %v: %v; want line %d %s warning", i, d, w.line, w.code)
+		}
+	}
+}
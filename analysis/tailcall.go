@@ -0,0 +1,38 @@
+package analysis
+
+import (
+	"github.com/verybigtuple/hackvmtranslator/parser"
+)
+
+// MinArgs returns the minimal number of args every function is called with.
+// The entries are entered from outside the program, e.g. Sys.init by the bootstrapping code
+// or a function by a test script, so they may get no args at all.
+// Functions which are never called are missing, as their args are unknown
+func MinArgs(files []File, entries []string) map[string]int {
+	res := make(map[string]int)
+	for _, fn := range entries {
+		res[fn] = 0
+	}
+	for _, f := range files {
+		for _, cmd := range f.Commands {
+			if cmd.CmdType != parser.CmdCall {
+				continue
+			}
+			if n, ok := res[cmd.Arg1]; !ok || cmd.Arg2 < n {
+				res[cmd.Arg1] = cmd.Arg2
+			}
+		}
+	}
+	return res
+}
+
+// IsTailCall reports if the commands start with a call immediately followed by return
+// which can reuse the frame of the function fn. The frame is reused if the callee takes
+// no more args than fn is called with, so the new args and the frame are moved down
+func IsTailCall(cmds []parser.Command, fn string, minArgs map[string]int) bool {
+	if len(cmds) < 2 || cmds[0].CmdType != parser.CmdCall || cmds[1].CmdType != parser.CmdReturn {
+		return false
+	}
+	n, ok := minArgs[fn]
+	return ok && cmds[0].Arg2 <= n
+}
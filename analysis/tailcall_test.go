@@ -0,0 +1,52 @@
+package analysis
+
+import (
+	"testing"
+)
+
+func TestMinArgs(t *testing.T) {
+	files := []File{
+		parseFile(t, "Main.vm", "function Main.f 0\ncall Main.g 2\ncall Main.g 1\ncall Main.h 3\nreturn\n"),
+	}
+	minArgs := MinArgs(files, []string{SysInit})
+	want := map[string]int{SysInit: 0, "Main.g": 1, "Main.h": 3}
+	if len(minArgs) != len(want) {
+		t.Errorf("Actual %v; want %v", minArgs, want)
+	}
+	for fn, n := range want {
+		if minArgs[fn] != n {
+			t.Errorf("%s: actual %d; want %d", fn, minArgs[fn], n)
+		}
+	}
+	if _, ok := MinArgs(files, nil)[SysInit]; ok {
+		t.Errorf("Sys.init is not called without the bootstrap")
+	}
+	// An entry may be called with more args inside the program
+	if n := MinArgs(files, []string{"Main.g"})["Main.g"]; n != 0 {
+		t.Errorf("Entry Main.g gets %d args; want 0", n)
+	}
+}
+
+func TestIsTailCall(t *testing.T) {
+	f := parseFile(t, "Main.vm", "call Main.g 2\nreturn\ncall Main.g 2\npush constant 0\nreturn\n")
+	minArgs := map[string]int{"Main.f": 2, "Main.one": 1}
+	testCases := []struct {
+		desc  string
+		start int
+		fn    string
+		want  bool
+	}{
+		{"Tail call", 0, "Main.f", true},
+		{"Too few args", 0, "Main.one", false},
+		{"Unknown args", 0, "Main.unknown", false},
+		{"Outside functions", 0, "", false},
+		{"Not followed by return", 2, "Main.f", false},
+		{"Return", 1, "Main.f", false},
+		{"Last command", 4, "Main.f", false},
+	}
+	for _, tc := range testCases {
+		if actual := IsTailCall(f.Commands[tc.start:], tc.fn, minArgs); actual != tc.want {
+			t.Errorf("%s: actual %v; want %v", tc.desc, actual, tc.want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+// Package assembler translates Hack assembly into Hack machine code
+package assembler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// VarBaseAddr is the address of the first variable
+const VarBaseAddr = 16
+
+// MaxAddress is the max value an A-instruction can hold
+const MaxAddress = 1<<15 - 1
+
+var predefined = map[string]uint16{
+	"SP":     0,
+	"LCL":    1,
+	"ARG":    2,
+	"THIS":   3,
+	"THAT":   4,
+	"SCREEN": 16384,
+	"KBD":    24576,
+}
+
+func init() {
+	for i := 0; i < 16; i++ {
+		predefined["R"+strconv.Itoa(i)] = uint16(i)
+	}
+}
+
+var compCodes = map[string]uint16{
+	"0":   0b0101010,
+	"1":   0b0111111,
+	"-1":  0b0111010,
+	"D":   0b0001100,
+	"A":   0b0110000,
+	"!D":  0b0001101,
+	"!A":  0b0110001,
+	"-D":  0b0001111,
+	"-A":  0b0110011,
+	"D+1": 0b0011111,
+	"A+1": 0b0110111,
+	"D-1": 0b0001110,
+	"A-1": 0b0110010,
+	"D+A": 0b0000010,
+	"D-A": 0b0010011,
+	"A-D": 0b0000111,
+	"D&A": 0b0000000,
+	"D|A": 0b0010101,
+	"M":   0b1110000,
+	"!M":  0b1110001,
+	"-M":  0b1110011,
+	"M+1": 0b1110111,
+	"M-1": 0b1110010,
+	"D+M": 0b1000010,
+	"D-M": 0b1010011,
+	"M-D": 0b1000111,
+	"D&M": 0b1000000,
+	"D|M": 0b1010101,
+}
+
+// Commutative forms which are accepted by the nand2tetris tools as well
+var compAliases = map[string]string{
+	"1+D": "D+1",
+	"1+A": "A+1",
+	"1+M": "M+1",
+	"A+D": "D+A",
+	"M+D": "D+M",
+	"A&D": "D&A",
+	"M&D": "D&M",
+	"A|D": "D|A",
+	"M|D": "D|M",
+}
+
+var jumpCodes = map[string]uint16{
+	"":    0,
+	"JGT": 1,
+	"JEQ": 2,
+	"JGE": 3,
+	"JLT": 4,
+	"JNE": 5,
+	"JLE": 6,
+	"JMP": 7,
+}
+
+// Program is an assembled Hack program
+type Program struct {
+	Code   []uint16
+	Labels map[string]uint16 // ROM addresses of (labels)
+	Vars   map[string]uint16 // RAM addresses of variables, e.g. File.5
+}
+
+type line struct {
+	num  int
+	text string
+}
+
+// Assemble reads Hack assembly and returns machine code.
+// Labels are resolved in the first pass, variables get addresses from VarBaseAddr upward
+// in the order of their first appearance
+func Assemble(r io.Reader) (*Program, error) {
+	prog := &Program{
+		Labels: make(map[string]uint16),
+		Vars:   make(map[string]uint16),
+	}
+
+	// First pass: collect instructions and labels
+	var instrs []line
+	scanner := bufio.NewScanner(r)
+	lCount := 0
+	for scanner.Scan() {
+		lCount++
+		text := cleanLine(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if strings.HasPrefix(text, "(") {
+			if !strings.HasSuffix(text, ")") || len(text) < 3 {
+				return nil, fmt.Errorf("Line %d: Illegal label %s", lCount, text)
+			}
+			label := text[1 : len(text)-1]
+			if !isValidSymbol(label) {
+				return nil, fmt.Errorf("Line %d: Illegal label name %s", lCount, label)
+			}
+			if _, ok := prog.Labels[label]; ok {
+				return nil, fmt.Errorf("Line %d: Duplicate label %s", lCount, label)
+			}
+			if len(instrs) > MaxAddress {
+				return nil, fmt.Errorf("Line %d: Program is too large", lCount)
+			}
+			prog.Labels[label] = uint16(len(instrs))
+			continue
+		}
+		instrs = append(instrs, line{lCount, text})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(instrs) > MaxAddress+1 {
+		return nil, fmt.Errorf("Program is too large: %d instructions", len(instrs))
+	}
+
+	// Second pass: encode instructions
+	nextVar := uint16(VarBaseAddr)
+	prog.Code = make([]uint16, 0, len(instrs))
+	for _, l := range instrs {
+		var code uint16
+		var err error
+		if strings.HasPrefix(l.text, "@") {
+			code, err = prog.encodeA(l.text[1:], &nextVar)
+		} else {
+			code, err = encodeC(l.text)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %w", l.num, err)
+		}
+		prog.Code = append(prog.Code, code)
+	}
+	return prog, nil
+}
+
+// WriteHack writes the machine code as text lines of 16 binary digits
+func WriteHack(w io.Writer, code []uint16) error {
+	bw := bufio.NewWriter(w)
+	for _, c := range code {
+		if _, err := fmt.Fprintf(bw, "%016b\n", c); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func cleanLine(s string) string {
+	if idx := strings.Index(s, "//"); idx >= 0 {
+		s = s[:idx]
+	}
+	return strings.Join(strings.Fields(s), "")
+}
+
+func isValidSymbol(s string) bool {
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '_', r == '.', r == '$', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (p *Program) encodeA(value string, nextVar *uint16) (uint16, error) {
+	if value == "" {
+		return 0, fmt.Errorf("Empty A-instruction")
+	}
+	if value[0] >= '0' && value[0] <= '9' {
+		n, err := strconv.Atoi(value)
+		if err != nil || n > MaxAddress {
+			return 0, fmt.Errorf("Illegal constant %s", value)
+		}
+		return uint16(n), nil
+	}
+	if !isValidSymbol(value) {
+		return 0, fmt.Errorf("Illegal symbol %s", value)
+	}
+	if addr, ok := predefined[value]; ok {
+		return addr, nil
+	}
+	if addr, ok := p.Labels[value]; ok {
+		return addr, nil
+	}
+	if addr, ok := p.Vars[value]; ok {
+		return addr, nil
+	}
+	addr := *nextVar
+	p.Vars[value] = addr
+	*nextVar++
+	return addr, nil
+}
+
+func encodeC(text string) (uint16, error) {
+	dest, comp, jump := "", text, ""
+	if idx := strings.Index(comp, "="); idx >= 0 {
+		dest, comp = comp[:idx], comp[idx+1:]
+	}
+	if idx := strings.Index(comp, ";"); idx >= 0 {
+		comp, jump = comp[:idx], comp[idx+1:]
+	}
+
+	if alias, ok := compAliases[comp]; ok {
+		comp = alias
+	}
+	c, ok := compCodes[comp]
+	if !ok {
+		return 0, fmt.Errorf("Illegal computation %s", comp)
+	}
+	j, ok := jumpCodes[jump]
+	if !ok {
+		return 0, fmt.Errorf("Illegal jump %s", jump)
+	}
+	var d uint16
+	for _, r := range dest {
+		var bit uint16
+		switch r {
+		case 'A':
+			bit = 0b100
+		case 'D':
+			bit = 0b010
+		case 'M':
+			bit = 0b001
+		default:
+			return 0, fmt.Errorf("Illegal destination %s", dest)
+		}
+		if d&bit != 0 {
+			return 0, fmt.Errorf("Illegal destination %s", dest)
+		}
+		d |= bit
+	}
+	return 0b111<<13 | c<<6 | d<<3 | j, nil
+}
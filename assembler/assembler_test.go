@@ -0,0 +1,128 @@
+package assembler
+
+import (
+	"strings"
+	"testing"
+)
+
+func assembleString(t *testing.T, s string) *Program {
+	t.Helper()
+	prog, err := Assemble(strings.NewReader(s))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	return prog
+}
+
+func TestAssembleAdd(t *testing.T) {
+	src := `
+	// Computes R0 = 2 + 3
+	@2
+	D=A
+	@3
+	D=D+A
+	@0
+	M=D
+	`
+	want := []string{
+		"0000000000000010",
+		"1110110000010000",
+		"0000000000000011",
+		"1110000010010000",
+		"0000000000000000",
+		"1110001100001000",
+	}
+	prog := assembleString(t, src)
+
+	sb := strings.Builder{}
+	if err := WriteHack(&sb, prog.Code); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	actual := strings.Fields(sb.String())
+	if len(actual) != len(want) {
+		t.Fatalf("Actual len: %v; want len: %v", len(actual), len(want))
+	}
+	for i := range want {
+		if actual[i] != want[i] {
+			t.Errorf("Line %v, Actual %v; want %v", i, actual[i], want[i])
+		}
+	}
+}
+
+func TestAssembleSymbols(t *testing.T) {
+	src := `
+	@Foo.5
+	D=M
+	(Foo.bar$LOOP)
+	@Foo.bar$LOOP
+	0;JMP
+	@Foo.6
+	@Foo.5
+	@SP
+	@R13
+	@SCREEN
+	`
+	want := []uint16{16, 0xFC10, 2, 0xEA87, 17, 16, 0, 13, 16384}
+	prog := assembleString(t, src)
+	if len(prog.Code) != len(want) {
+		t.Fatalf("Actual len: %v; want len: %v", len(prog.Code), len(want))
+	}
+	for i := range want {
+		if prog.Code[i] != want[i] {
+			t.Errorf("Instr %v, Actual %016b; want %016b", i, prog.Code[i], want[i])
+		}
+	}
+	if prog.Labels["Foo.bar$LOOP"] != 2 {
+		t.Errorf("Wrong label address %v", prog.Labels["Foo.bar$LOOP"])
+	}
+	if prog.Vars["Foo.6"] != 17 {
+		t.Errorf("Wrong var address %v", prog.Vars["Foo.6"])
+	}
+}
+
+func TestAssembleCInstr(t *testing.T) {
+	testCases := []struct {
+		instr string
+		want  uint16
+	}{
+		{"AM=M-1", 0b1111110010101000},
+		{"D;JNE", 0b1110001100000101},
+		{"AMD=D|M", 0b1111010101111000},
+		{"M=-1", 0b1110111010001000},
+		{"A=!D", 0b1110001101100000},
+		{"M=M+D", 0b1111000010001000},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.instr, func(t *testing.T) {
+			prog := assembleString(t, tc.instr)
+			if prog.Code[0] != tc.want {
+				t.Errorf("Actual %016b; want %016b", prog.Code[0], tc.want)
+			}
+		})
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	testCases := []struct {
+		desc string
+		src  string
+	}{
+		{"Unknown comp", "D=D*A"},
+		{"Unknown jump", "0;JUMP"},
+		{"Wrong dest", "X=D"},
+		{"Too big constant", "@32768"},
+		{"Duplicate label", "(L)\n(L)"},
+		{"Bad label", "(1L)"},
+		{"Unclosed label", "(L"},
+		{"Empty A", "@"},
+		{"Label past ROM", strings.Repeat("D=0\n", MaxAddress+1) + "(END)"},
+		{"Too many instructions", strings.Repeat("D=0\n", MaxAddress+2)},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if _, err := Assemble(strings.NewReader(tc.src)); err == nil {
+				t.Errorf("Error is not arisen")
+			}
+		})
+	}
+}
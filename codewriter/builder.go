@@ -1,7 +1,6 @@
 package codewriter
 
 import (
-	"bytes"
 	"strconv"
 	"strings"
 
@@ -36,75 +35,110 @@ var pointerOffsets = map[int]segmInstr{
 	1: that,
 }
 
+type instrKind int
+
+const (
+	instrComment instrKind = iota
+	instrLabel             // (text)
+	instrA                 // @text
+	instrC                 // dest=comp;jump
+)
+
+// asmInstr is an instruction of the intermediate representation between asmBuilder
+// and the writer. Comments and labels are instructions as well
+type asmInstr struct {
+	kind instrKind
+	text string
+}
+
+func (in asmInstr) String() string {
+	switch in.kind {
+	case instrComment:
+		return parser.CommentPrefix + " " + in.text
+	case instrLabel:
+		return "(" + in.text + ")"
+	case instrA:
+		return "@" + in.text
+	}
+	return in.text
+}
+
 type asmBuilder struct {
-	builder *bytes.Buffer // byte buffer does not reallocates while reset (strings.Builder does)
+	instrs []asmInstr
+	sb     strings.Builder
 }
 
 func newAsmBuilder() *asmBuilder {
-	b := bytes.Buffer{}
-	return &asmBuilder{&b}
+	return &asmBuilder{}
 }
 
+// CodeAsm returns the text of the added instructions and resets the builder
 func (ah *asmBuilder) CodeAsm() string {
-	result := ah.builder.String()
-	ah.builder.Reset()
-	return result
+	ah.sb.Reset()
+	writeInstrs(&ah.sb, ah.instrs)
+	ah.instrs = ah.instrs[:0]
+	return ah.sb.String()
 }
 
-func (ah *asmBuilder) AddComment(comment string) {
-	if !strings.HasPrefix(comment, parser.CommentPrefix) {
-		ah.builder.WriteString(parser.CommentPrefix + " " + comment + "\n")
-	} else {
-		ah.builder.WriteString(comment + "\n")
+// Instrs returns the added instructions and resets the builder
+func (ah *asmBuilder) Instrs() []asmInstr {
+	res := make([]asmInstr, len(ah.instrs))
+	copy(res, ah.instrs)
+	ah.instrs = ah.instrs[:0]
+	return res
+}
+
+func writeInstrs(sb *strings.Builder, instrs []asmInstr) {
+	for _, in := range instrs {
+		sb.WriteString(in.String())
+		sb.WriteRune('\n')
 	}
 }
 
+func (ah *asmBuilder) add(kind instrKind, text string) {
+	ah.instrs = append(ah.instrs, asmInstr{kind, text})
+}
+
+func (ah *asmBuilder) AddComment(comment string) {
+	comment = strings.TrimPrefix(comment, parser.CommentPrefix)
+	ah.add(instrComment, strings.TrimPrefix(comment, " "))
+}
+
 // ToStack adds asm code which move SP pointer and push the value of the D-register
 // to the stack
 func (ah *asmBuilder) ToStack(calc string) {
 	ah.AsmCmds(sp, "M=M+1", "A=M-1")
-	ah.builder.WriteString("M=")
-	ah.builder.WriteString(calc)
-	ah.builder.WriteRune('\n')
+	ah.add(instrC, "M="+calc)
 }
 
 // FromStack adds asm code which move SP pointer and pop value from the stack to the D-Register
 func (ah *asmBuilder) FromStack(dest string) {
 	ah.AsmCmds(sp, "AM=M-1")
-	ah.builder.WriteString(dest)
-	ah.builder.WriteString("=M\n")
+	ah.add(instrC, dest+"=M")
 }
 
 func (ah *asmBuilder) AsmCmds(cmds ...interface{}) {
 	for _, c := range cmds {
 		switch v := c.(type) {
 		case int:
-			s := strconv.Itoa(v)
-			ah.builder.WriteRune('@')
-			ah.builder.WriteString(s)
-			ah.builder.WriteRune('\n')
+			ah.add(instrA, strconv.Itoa(v))
 		case freeReg:
-			ah.builder.WriteRune('@')
-			ah.builder.WriteString(string(v))
-			ah.builder.WriteRune('\n')
+			ah.add(instrA, string(v))
 		case segmInstr:
-			ah.builder.WriteRune('@')
-			ah.builder.WriteString(string(v))
-			ah.builder.WriteRune('\n')
+			ah.add(instrA, string(v))
 		case string:
-			ah.builder.WriteString(v)
-			ah.builder.WriteRune('\n')
+			if strings.HasPrefix(v, "@") {
+				ah.add(instrA, v[1:])
+			} else {
+				ah.add(instrC, v)
+			}
 		}
 	}
 }
 
 // StaticAinstr adds a static A-instruction. Like @file.5
 func (ah *asmBuilder) StaticAinstr(prefix string, id int) {
-	ah.builder.WriteRune('@')
-	ah.builder.WriteString(prefix)
-	ah.builder.WriteRune('.')
-	ah.builder.WriteString(strconv.Itoa(id))
-	ah.builder.WriteRune('\n')
+	ah.add(instrA, prefix+"."+strconv.Itoa(id))
 }
 
 // StaticAinstr adds a temp A-instruction. Like @7
@@ -122,53 +156,18 @@ func (ah *asmBuilder) SegmentAinstr(vmSegment string) {
 	ah.AsmCmds(varSegments[vmSegment])
 }
 
-func (ah *asmBuilder) funcLabel(fnPrefix, label string) {
-	ah.builder.WriteString(fnPrefix)
-	ah.builder.WriteRune('$')
-	ah.builder.WriteString(label)
-}
-
 func (ah *asmBuilder) AtFuncLabel(fnPrefix, label string) {
-	ah.builder.WriteRune('@')
-	ah.funcLabel(fnPrefix, label)
-	ah.builder.WriteRune('\n')
+	ah.add(instrA, fnPrefix+"$"+label)
 }
 
 func (ah *asmBuilder) SetFuncLabel(fnPrefix, label string) {
-	ah.builder.WriteRune('(')
-	ah.funcLabel(fnPrefix, label)
-	ah.builder.WriteString(")\n")
-}
-
-func (ah *asmBuilder) arithmCondLabel(statPrefix, cond string, idx int) {
-	// static.EQ_END_5
-	ah.builder.WriteString(statPrefix)
-	ah.builder.WriteRune('.')
-	ah.builder.WriteString(strings.ToUpper(cond))
-	ah.builder.WriteString("_END_")
-	ah.builder.WriteString(strconv.Itoa(idx))
-}
-
-func (ah *asmBuilder) AtArithmCondLabel(statPrefix, cond string, idx int) {
-	ah.builder.WriteRune('@')
-	ah.arithmCondLabel(statPrefix, cond, idx)
-	ah.builder.WriteRune('\n')
-}
-
-func (ah *asmBuilder) SetArithmCondLabel(statPrefix, cond string, idx int) {
-	ah.builder.WriteRune('(')
-	ah.arithmCondLabel(statPrefix, cond, idx)
-	ah.builder.WriteString(")\n")
+	ah.add(instrLabel, fnPrefix+"$"+label)
 }
 
 func (ah *asmBuilder) AtLabel(label string) {
-	ah.builder.WriteRune('@')
-	ah.builder.WriteString(label)
-	ah.builder.WriteRune('\n')
+	ah.add(instrA, label)
 }
 
 func (ah *asmBuilder) SetLabel(label string) {
-	ah.builder.WriteRune('(')
-	ah.builder.WriteString(label)
-	ah.builder.WriteString(")\n")
+	ah.add(instrLabel, label)
 }
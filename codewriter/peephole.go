@@ -0,0 +1,240 @@
+package codewriter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PeepholeRules is a set of rules of the peephole optimizer
+type PeepholeRules uint
+
+// Rules of the peephole optimizer
+const (
+	// PeepholePushPop fuses a push immediately followed by a pop into a move
+	// through the D-register, e.g. push constant 5; pop local 0
+	PeepholePushPop PeepholeRules = 1 << iota
+	// PeepholeRedundantAt removes A-instructions loading the address the A-register already holds
+	PeepholeRedundantAt
+	// PeepholeJumpNext removes jumps to a label which follows them
+	PeepholeJumpNext
+
+	PeepholeAll = PeepholePushPop | PeepholeRedundantAt | PeepholeJumpNext
+)
+
+type peepholeRule struct {
+	rule PeepholeRules
+	name string
+	pass func([]asmInstr) ([]asmInstr, bool)
+}
+
+// peepholeRules are applied in this order until none of them changes the code
+var peepholeRules = []peepholeRule{
+	{PeepholePushPop, "pushpop", fusePushPop},
+	{PeepholeRedundantAt, "redundant-at", removeRedundantAt},
+	{PeepholeJumpNext, "jump-next", removeJumpNext},
+}
+
+// ParsePeepholeRules parses a comma separated list of rule names.
+// "all" turns on all rules, "none" and an empty string turn them off
+func ParsePeepholeRules(s string) (PeepholeRules, error) {
+	var rules PeepholeRules
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "", "none":
+			continue
+		case "all":
+			rules |= PeepholeAll
+			continue
+		}
+		found := false
+		for _, r := range peepholeRules {
+			if r.name == name {
+				rules |= r.rule
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("Unknown peephole rule %q", name)
+		}
+	}
+	return rules, nil
+}
+
+// String returns the names of the rules separated by commas
+func (r PeepholeRules) String() string {
+	var names []string
+	for _, pr := range peepholeRules {
+		if r&pr.rule != 0 {
+			names = append(names, pr.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// optimize applies the rules to the instructions until nothing changes
+func optimize(instrs []asmInstr, rules PeepholeRules) []asmInstr {
+	res := append([]asmInstr(nil), instrs...)
+	for changed := true; changed; {
+		changed = false
+		for _, pr := range peepholeRules {
+			if rules&pr.rule == 0 {
+				continue
+			}
+			var c bool
+			res, c = pr.pass(res)
+			changed = changed || c
+		}
+	}
+	return res
+}
+
+// nextInstr returns the index of the first instruction from i which is not a comment
+// or len(instrs) if there is no such instruction
+func nextInstr(instrs []asmInstr, i int) int {
+	for i < len(instrs) && instrs[i].kind == instrComment {
+		i++
+	}
+	return i
+}
+
+// cDest returns the destination of a C-instruction
+func cDest(text string) string {
+	if i := strings.IndexByte(text, '='); i >= 0 {
+		return text[:i]
+	}
+	return ""
+}
+
+// matchPushPop matches a push followed by a pop from index i:
+//
+//	@SP M=M+1 A=M-1 M=<calc> @SP AM=M-1 D=M <address> M=D
+//
+// and returns the index of D=M and calc. The address is computed with A-instructions
+// and C-instructions writing only to A. Calc must not read A or M as they differ
+// without the push. The popped slot is not written, so only pops storing D right away
+// are fused: compare sequences read the slot after their pop
+func matchPushPop(instrs []asmInstr, i int) (int, string, bool) {
+	pattern := []asmInstr{
+		{instrA, string(sp)}, {instrC, "M=M+1"}, {instrC, "A=M-1"}, {instrC, "M="},
+		{instrA, string(sp)}, {instrC, "AM=M-1"}, {instrC, "D=M"},
+	}
+	calc := ""
+	j := i
+	for pi, p := range pattern {
+		if pi > 0 {
+			j = nextInstr(instrs, j+1)
+		}
+		if j >= len(instrs) || instrs[j].kind != p.kind {
+			return 0, "", false
+		}
+		if p.text == "M=" {
+			if !strings.HasPrefix(instrs[j].text, p.text) {
+				return 0, "", false
+			}
+			calc = strings.TrimPrefix(instrs[j].text, p.text)
+			if strings.ContainsAny(calc, "AM;") {
+				return 0, "", false
+			}
+		} else if instrs[j].text != p.text {
+			return 0, "", false
+		}
+	}
+	for k := nextInstr(instrs, j+1); k < len(instrs); k = nextInstr(instrs, k+1) {
+		in := instrs[k]
+		switch {
+		case in.kind == instrA:
+		case in.kind == instrC && in.text == "M=D":
+			return j, calc, true
+		case in.kind == instrC && cDest(in.text) == "A" && !strings.Contains(in.text, ";"):
+		default:
+			return 0, "", false
+		}
+	}
+	return 0, "", false
+}
+
+// fusePushPop replaces a push followed by a pop to D with D=<calc>
+func fusePushPop(instrs []asmInstr) ([]asmInstr, bool) {
+	res := make([]asmInstr, 0, len(instrs))
+	changed := false
+	for i := 0; i < len(instrs); i++ {
+		end, calc, ok := matchPushPop(instrs, i)
+		if !ok {
+			res = append(res, instrs[i])
+			continue
+		}
+		if calc != "D" {
+			res = append(res, asmInstr{instrC, "D=" + calc})
+		}
+		for _, in := range instrs[i:end] {
+			if in.kind == instrComment {
+				res = append(res, in)
+			}
+		}
+		i = end
+		changed = true
+	}
+	return res, changed
+}
+
+// removeRedundantAt removes A-instructions which load the value A already holds.
+// A is unknown after a label and after C-instructions writing to A
+func removeRedundantAt(instrs []asmInstr) ([]asmInstr, bool) {
+	res := make([]asmInstr, 0, len(instrs))
+	changed := false
+	known := ""
+	for _, in := range instrs {
+		switch in.kind {
+		case instrLabel:
+			known = ""
+		case instrA:
+			if in.text == known {
+				changed = true
+				continue
+			}
+			known = in.text
+		case instrC:
+			if strings.Contains(cDest(in.text), "A") {
+				known = ""
+			}
+		}
+		res = append(res, in)
+	}
+	return res, changed
+}
+
+// removeJumpNext removes @L and a jump without a destination when only comments
+// and labels including (L) are between the jump and the next instruction
+func removeJumpNext(instrs []asmInstr) ([]asmInstr, bool) {
+	res := make([]asmInstr, 0, len(instrs))
+	changed := false
+	for i := 0; i < len(instrs); i++ {
+		if instrs[i].kind == instrA {
+			j := nextInstr(instrs, i+1)
+			if j < len(instrs) && instrs[j].kind == instrC &&
+				cDest(instrs[j].text) == "" && strings.Contains(instrs[j].text, ";") &&
+				labelFollows(instrs, j+1, instrs[i].text) {
+				res = append(res, instrs[i+1:j]...)
+				i = j
+				changed = true
+				continue
+			}
+		}
+		res = append(res, instrs[i])
+	}
+	return res, changed
+}
+
+// labelFollows reports if the label is set before the next instruction from index i
+func labelFollows(instrs []asmInstr, i int, label string) bool {
+	for ; i < len(instrs) && instrs[i].kind != instrA && instrs[i].kind != instrC; i++ {
+		if instrs[i].kind == instrLabel && instrs[i].text == label {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,179 @@
+package codewriter
+
+import (
+	"strings"
+	"testing"
+)
+
+// instrsFromAsm converts asm lines to the instructions of the builder
+func instrsFromAsm(lines ...string) []asmInstr {
+	res := make([]asmInstr, 0, len(lines))
+	for _, l := range lines {
+		switch {
+		case strings.HasPrefix(l, "//"):
+			res = append(res, asmInstr{instrComment, strings.TrimPrefix(l, "// ")})
+		case strings.HasPrefix(l, "("):
+			res = append(res, asmInstr{instrLabel, strings.Trim(l, "()")})
+		case strings.HasPrefix(l, "@"):
+			res = append(res, asmInstr{instrA, l[1:]})
+		default:
+			res = append(res, asmInstr{instrC, l})
+		}
+	}
+	return res
+}
+
+func runPeephole(t *testing.T, rules PeepholeRules, code, want []string) {
+	t.Helper()
+	sb := strings.Builder{}
+	writeInstrs(&sb, optimize(instrsFromAsm(code...), rules))
+	actual := strings.Split(strings.TrimSuffix(sb.String(), "\n"), "\n")
+	if strings.Join(actual, " ") != strings.Join(want, " ") {
+		t.Errorf("Actual:\n%s\nwant:\n%s", strings.Join(actual, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestPeepholePushPop(t *testing.T) {
+	testCases := []struct {
+		desc string
+		code []string
+		want []string
+	}{
+		{
+			"Constant to local",
+			[]string{
+				"// push constant 5", "@5", "D=A", "@SP", "M=M+1", "A=M-1", "M=D",
+				"// pop local 1", "@SP", "AM=M-1", "D=M", "@LCL", "A=M+1", "M=D",
+			},
+			[]string{"// push constant 5", "@5", "D=A", "// pop local 1", "@LCL", "A=M+1", "M=D"},
+		},
+		{
+			"Calculated value",
+			[]string{"@SP", "M=M+1", "A=M-1", "M=-1", "@SP", "AM=M-1", "D=M", "@5", "M=D"},
+			[]string{"D=-1", "@5", "M=D"},
+		},
+		{
+			"Value reads memory",
+			[]string{"@SP", "M=M+1", "A=M-1", "M=M+1", "@SP", "AM=M-1", "D=M", "@5", "M=D"},
+			[]string{"@SP", "M=M+1", "A=M-1", "M=M+1", "@SP", "AM=M-1", "D=M", "@5", "M=D"},
+		},
+		{
+			"Pop followed by a jump",
+			[]string{"@SP", "M=M+1", "A=M-1", "M=D", "@SP", "AM=M-1", "D=M", "@L", "D;JNE", "@5", "M=D"},
+			[]string{"@SP", "M=M+1", "A=M-1", "M=D", "@SP", "AM=M-1", "D=M", "@L", "D;JNE", "@5", "M=D"},
+		},
+		{
+			"Label between",
+			[]string{"@SP", "M=M+1", "A=M-1", "M=D", "(L)", "@SP", "AM=M-1", "D=M", "@5", "M=D"},
+			[]string{"@SP", "M=M+1", "A=M-1", "M=D", "(L)", "@SP", "AM=M-1", "D=M", "@5", "M=D"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			runPeephole(t, PeepholePushPop, tc.code, tc.want)
+		})
+	}
+}
+
+func TestPeepholeRedundantAt(t *testing.T) {
+	testCases := []struct {
+		desc string
+		code []string
+		want []string
+	}{
+		{
+			"Repeated SP",
+			[]string{"@SP", "M=M+1", "@SP", "A=M-1", "M=D"},
+			[]string{"@SP", "M=M+1", "A=M-1", "M=D"},
+		},
+		{
+			"A is changed",
+			[]string{"@SP", "AM=M-1", "@SP", "M=D"},
+			[]string{"@SP", "AM=M-1", "@SP", "M=D"},
+		},
+		{
+			"After label",
+			[]string{"@SP", "M=D", "(L)", "@SP", "M=D"},
+			[]string{"@SP", "M=D", "(L)", "@SP", "M=D"},
+		},
+		{
+			"Comment between",
+			[]string{"@R13", "M=D", "// next", "@R13", "A=M"},
+			[]string{"@R13", "M=D", "// next", "A=M"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			runPeephole(t, PeepholeRedundantAt, tc.code, tc.want)
+		})
+	}
+}
+
+func TestPeepholeJumpNext(t *testing.T) {
+	testCases := []struct {
+		desc string
+		code []string
+		want []string
+	}{
+		{
+			"Jump to next",
+			[]string{"@f$L", "0;JMP", "// label L", "(f$L)", "D=0"},
+			[]string{"// label L", "(f$L)", "D=0"},
+		},
+		{
+			"Several labels",
+			[]string{"@f$L", "D;JNE", "(f$K)", "(f$L)", "D=0"},
+			[]string{"(f$K)", "(f$L)", "D=0"},
+		},
+		{
+			"Instruction between",
+			[]string{"@f$L", "0;JMP", "D=0", "(f$L)"},
+			[]string{"@f$L", "0;JMP", "D=0", "(f$L)"},
+		},
+		{
+			"Jump with destination",
+			[]string{"@f$L", "D=D-1;JNE", "(f$L)"},
+			[]string{"@f$L", "D=D-1;JNE", "(f$L)"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			runPeephole(t, PeepholeJumpNext, tc.code, tc.want)
+		})
+	}
+}
+
+func TestPeepholeAll(t *testing.T) {
+	// The fused push and pop makes the second @R13 redundant
+	code := []string{
+		"@R13", "M=D", "@SP", "M=M+1", "A=M-1", "M=D",
+		"@SP", "AM=M-1", "D=M", "@R13", "M=D", "@f$L", "0;JMP", "(f$L)",
+	}
+	runPeephole(t, PeepholeAll, code, []string{"@R13", "M=D", "M=D", "(f$L)"})
+}
+
+func TestParsePeepholeRules(t *testing.T) {
+	testCases := []struct {
+		in   string
+		want PeepholeRules
+	}{
+		{"", 0},
+		{"none", 0},
+		{"all", PeepholeAll},
+		{"pushpop", PeepholePushPop},
+		{"redundant-at, jump-next", PeepholeRedundantAt | PeepholeJumpNext},
+	}
+	for _, tc := range testCases {
+		actual, err := ParsePeepholeRules(tc.in)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tc.in, err)
+			continue
+		}
+		if actual != tc.want {
+			t.Errorf("%q: actual %v; want %v", tc.in, actual, tc.want)
+		}
+	}
+	if _, err := ParsePeepholeRules("pushpop,unknown"); err == nil {
+		t.Errorf("Error is expected for an unknown rule")
+	}
+}
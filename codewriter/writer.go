@@ -3,14 +3,75 @@ package codewriter
 import (
 	"bufio"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/verybigtuple/hackvmtranslator/parser"
 )
 
+// Options select modes of the code generation
+type Options struct {
+	// CompactCalls makes call and return commands jump to the shared routines
+	// written by WriteRuntime instead of inlining the whole sequences
+	CompactCalls bool
+	// SharedCompare makes eq, gt and lt commands jump to the shared routines
+	// written by WriteRuntime. The return address is passed in the D-register
+	SharedCompare bool
+	// Peephole selects the rules of the peephole optimizer. With any rule on
+	// the code is buffered until Flush
+	Peephole PeepholeRules
+	// CacheTOS keeps the top of the stack in the D-register between push, pop,
+	// arithmetic and if-goto commands. It is spilled to memory before other commands
+	CacheTOS bool
+}
+
+// NeedsRuntime reports if the code calls the shared routines written by WriteRuntime
+func (o Options) NeedsRuntime() bool {
+	return o.CompactCalls || o.SharedCompare
+}
+
+// Labels of the shared runtime routines
+const (
+	haltLabel   = "$$HALT"
+	callLabel   = "$$CALL"
+	returnLabel = "$$RETURN"
+)
+
+// compareLabel returns the label of the shared routine of a comparison: $$EQ, $$GT or $$LT
+func compareLabel(cond string) string {
+	return "$$" + strings.ToUpper(cond)
+}
+
+// Jumps to the end of comparisons if the result is false. D=x-y
+var compareFalseJumps = map[string]string{
+	parser.EqKey: "D;JNE",
+	parser.GtKey: "D;JLE",
+	parser.LtKey: "D;JGE",
+}
+
+// Arithmetic of the top of the stack cached in the D-register. x is in M for binary commands
+var (
+	cachedBinaryComps = map[string]string{
+		parser.AddKey: "D=D+M",
+		parser.SubKey: "D=M-D",
+		parser.AndKey: "D=D&M",
+		parser.OrKey:  "D=D|M",
+	}
+	cachedUnaryComps = map[string]string{
+		parser.NegKey: "D=-D",
+		parser.NotKey: "D=!D",
+	}
+)
+
 // CodeWriter is a struc that writes instructions to a user's writer
 type CodeWriter struct {
 	writer *bufio.Writer
 	asm    *asmBuilder
+	opts   Options
+	// Instructions waiting for the peephole optimizer
+	pending []asmInstr
+	// The top of the stack is in the D-register and SP does not count it
+	cached bool
 
 	name        string
 	stPrefix    string
@@ -38,6 +99,43 @@ func NewCodeWriter(w *bufio.Writer, name, stPrefix, fnPrefix string) *CodeWriter
 	return &cw
 }
 
+// SetOptions sets modes of the code generation. It must be called before writing
+func (cw *CodeWriter) SetOptions(opts Options) {
+	cw.opts = opts
+}
+
+// emit passes the instructions of the builder to the writer. They are kept
+// until Flush if the peephole optimizer is on
+func (cw *CodeWriter) emit() error {
+	if cw.opts.Peephole == 0 {
+		_, err := cw.writer.WriteString(cw.asm.CodeAsm())
+		return err
+	}
+	cw.pending = append(cw.pending, cw.asm.Instrs()...)
+	return nil
+}
+
+// Flush optimizes the buffered instructions and writes them to the writer.
+// The writer itself is not flushed. Flush must be called after the last command
+// and may be called between commands, but the optimizer does not see across the calls
+func (cw *CodeWriter) Flush() error {
+	if cw.cached {
+		cw.spill()
+		if err := cw.emit(); err != nil {
+			return err
+		}
+	}
+	if len(cw.pending) == 0 {
+		return nil
+	}
+	instrs := optimize(cw.pending, cw.opts.Peephole)
+	cw.pending = cw.pending[:0]
+	sb := strings.Builder{}
+	writeInstrs(&sb, instrs)
+	_, err := cw.writer.WriteString(sb.String())
+	return err
+}
+
 // NewCodeWriterBootstrap creates Codewriter for Bootstrap
 func NewCodeWriterBootstrap(w *bufio.Writer) *CodeWriter {
 	return NewCodeWriter(w, "Bootstrap", "", "")
@@ -57,32 +155,202 @@ var writers = map[parser.CommandType]func(*CodeWriter, parser.Command) (err erro
 	parser.CmdReturn:           (*CodeWriter).writeReturnCmd,
 }
 
+// cachingWriters handle the top of the stack cached in the D-register
+var cachingWriters = map[parser.CommandType]bool{
+	parser.CmdPush:             true,
+	parser.CmdPop:              true,
+	parser.CmdArithmeticBinary: true,
+	parser.CmdArithmeticUnary:  true,
+	parser.CmdIfGoto:           true,
+}
+
 // WriteCommand writes a command to a writer passed to NewCodeWriter
 func (cw *CodeWriter) WriteCommand(cmd parser.Command) error {
 	if w, ok := writers[cmd.CmdType]; ok {
+		if !cachingWriters[cmd.CmdType] {
+			cw.spill()
+		}
 		return w(cw, cmd)
 	}
 	return fmt.Errorf("There is no writer for cmd")
 }
 
-func (cw *CodeWriter) WriteBootstrap() (err error) {
+// spill pushes the top of the stack cached in the D-register to memory
+func (cw *CodeWriter) spill() {
+	if cw.cached {
+		cw.asm.ToStack("D")
+		cw.cached = false
+	}
+}
+
+func (cw *CodeWriter) WriteBootstrap() error {
 	// Init SP
 	cw.asm.AsmCmds(256, "D=A", sp, "M=D")
 	// Call Sys.init function
-	cw.writeCallCmd(parser.Command{parser.CmdCall, "Sys.init", 0})
+	cw.writeCallCmd(parser.Command{CmdType: parser.CmdCall, Arg1: parser.SysInit, Arg2: 0})
 	// In order not to have 2 lablels in a row
 	cw.asm.AsmCmds("D=0")
 
-	_, err = cw.writer.WriteString(cw.asm.CodeAsm())
-	return
+	return cw.emit()
+}
+
+// WriteRuntime writes the shared routines the code needs with the current options.
+// The routines are preceded by an infinite loop, so they are never reached by falling through
+func (cw *CodeWriter) WriteRuntime() error {
+	if cw.cached {
+		cw.spill()
+		if err := cw.emit(); err != nil {
+			return err
+		}
+	}
+	if !cw.opts.NeedsRuntime() {
+		return nil
+	}
+	cw.asm.AddComment("Runtime")
+	cw.asm.SetLabel(haltLabel)
+	cw.asm.AtLabel(haltLabel)
+	cw.asm.AsmCmds("0;JMP")
+
+	if cw.opts.CompactCalls {
+		cw.writeCallRoutine()
+		cw.writeReturnRoutine()
+	}
+	if cw.opts.SharedCompare {
+		for _, cond := range [...]string{parser.EqKey, parser.GtKey, parser.LtKey} {
+			cw.writeCompareRoutine(cond)
+		}
+	}
+	return cw.emit()
+}
+
+// writeCallRoutine writes the shared part of the call command.
+// R13 is the number of args, R14 is the address of the function, D is the return address
+func (cw *CodeWriter) writeCallRoutine() {
+	cw.asm.AddComment("call routine: R13 - args, R14 - function, D - return address")
+	cw.asm.SetLabel(callLabel)
+	// Push the return address without moving SP
+	cw.asm.AsmCmds(sp, "A=M", "M=D")
+	segm := [...]segmInstr{lcl, arg, this, that}
+	for _, s := range segm {
+		cw.asm.AsmCmds(s, "D=M", sp, "AM=M+1", "M=D")
+	}
+	// SP points to THAT, so move it to the empty register. LCL=SP
+	cw.asm.AsmCmds(sp, "MD=M+1", lcl, "M=D")
+	// ARG = SP-5-<func args>
+	cw.asm.AsmCmds(r13, "D=D-M", 5, "D=D-A", arg, "M=D")
+	cw.asm.AsmCmds(r14, "A=M", "0;JMP")
+}
+
+// writeReturnRoutine writes the return command as a shared routine
+func (cw *CodeWriter) writeReturnRoutine() {
+	cw.asm.AddComment("return routine")
+	cw.asm.SetLabel(returnLabel)
+	cw.writeReturnSequence()
+}
+
+// writeCompareRoutine writes a shared comparison. D is the return address
+func (cw *CodeWriter) writeCompareRoutine(cond string) {
+	label := compareLabel(cond)
+	cw.asm.AddComment(cond + " routine: D - return address")
+	cw.asm.SetLabel(label)
+	cw.asm.AsmCmds("@R15", "M=D")
+	cw.writeCompareSequence(cond, func(part string) string {
+		return label + "_" + part
+	})
+	cw.asm.AsmCmds("@R15", "A=M", "0;JMP")
+}
+
+// writeCompareSequence adds the instructions of a comparison. label returns the names of
+// its labels by their parts, e.g. END which is set after the instructions
+func (cw *CodeWriter) writeCompareSequence(cond string, label func(part string) string) {
+	endLabel := label("END")
+	if cond == parser.EqKey {
+		// x-y == 0 if and only if x == y even if the subtraction overflows
+		cw.asm.FromStack("D")
+		cw.asm.AsmCmds("A=A-1", "D=M-D")
+	} else {
+		cw.writeSafeDiff(label)
+		cw.asm.AsmCmds(sp, "A=M-1")
+	}
+	// By default set to false
+	cw.asm.AsmCmds("M=0")
+	cw.asm.AtLabel(endLabel)
+	cw.asm.AsmCmds(compareFalseJumps[cond])
+	// Set true
+	cw.asm.AsmCmds(sp, "A=M-1", "M=-1")
+	cw.asm.SetLabel(endLabel)
+}
+
+// writeSafeDiff pops y and sets D to a value with the sign of x-y without overflows:
+// x-y if x and y have the same sign, else x if x < 0 or 1 if y < 0.
+// x stays on the top of the stack
+func (cw *CodeWriter) writeSafeDiff(label func(part string) string) {
+	yNeg, same, diff := label("YNEG"), label("SAME"), label("DIFF")
+	cw.asm.FromStack("D")
+	cw.asm.AtLabel(yNeg)
+	cw.asm.AsmCmds("D;JLT")
+	// y >= 0. If x < 0, D = x
+	cw.asm.AsmCmds(sp, "A=M-1", "D=M")
+	cw.asm.AtLabel(diff)
+	cw.asm.AsmCmds("D;JLT")
+	// The same signs. D = x-y
+	cw.asm.SetLabel(same)
+	cw.asm.AsmCmds(sp, "A=M", "D=M", "A=A-1", "D=M-D")
+	cw.asm.AtLabel(diff)
+	cw.asm.AsmCmds("0;JMP")
+	// y < 0. If x >= 0, D = 1
+	cw.asm.SetLabel(yNeg)
+	cw.asm.AsmCmds(sp, "A=M-1", "D=M")
+	cw.asm.AtLabel(same)
+	cw.asm.AsmCmds("D;JLT", "D=1")
+	cw.asm.SetLabel(diff)
 }
 
 func (cw *CodeWriter) writePush(cmd parser.Command) error {
 	cw.asm.AddComment(fmt.Sprintf("push %s %d", cmd.Arg1, cmd.Arg2))
+	if cw.opts.CacheTOS {
+		cw.spill()
+		cw.loadPushValue(cmd)
+		cw.cached = true
+		return cw.emit()
+	}
+	// 0, 1 and -1 (true) are written straight into the new stack slot
+	if comp, ok := constComp(cmd); ok {
+		cw.asm.ToStack(comp)
+		return cw.emit()
+	}
+	cw.loadPushValue(cmd)
+	cw.asm.ToStack("D")
+	return cw.emit()
+}
+
+// constComp returns the computation of a push constant command if the ALU computes
+// the value without the A-register: 0, 1 or -1. The max constant 32767 has no shorter
+// encoding than @32767 D=A, so it is loaded like any other constant
+func constComp(cmd parser.Command) (string, bool) {
+	if !parser.IsConstantSegment(cmd.Arg1) || cmd.Arg2 < -1 || cmd.Arg2 > 1 {
+		return "", false
+	}
+	return strconv.Itoa(cmd.Arg2), true
+}
 
+// loadPushValue adds instructions loading the value of a push command to the D-register
+func (cw *CodeWriter) loadPushValue(cmd parser.Command) {
+	if comp, ok := constComp(cmd); ok {
+		cw.asm.AsmCmds("D=" + comp)
+		return
+	}
 	switch {
-	case parser.IsConstantSegment(cmd.Arg1): // push constant 2
+	case parser.IsConstantSegment(cmd.Arg1) && cmd.Arg2 >= 0: // push constant 2
 		cw.asm.AsmCmds(cmd.Arg2, "D=A")
+	case parser.IsConstantSegment(cmd.Arg1):
+		// Negative constants are not valid VM code, but folded constants may be negative.
+		// A-instructions are non-negative, so -32768 is !32767
+		if cmd.Arg2 < -parser.MaxConstant {
+			cw.asm.AsmCmds(parser.MaxConstant, "D=!A")
+		} else {
+			cw.asm.AsmCmds(-cmd.Arg2, "D=-A")
+		}
 	case parser.IsStaticSegment(cmd.Arg1): // push  static 2
 		cw.asm.StaticAinstr(cw.stPrefix, cmd.Arg2)
 		cw.asm.AsmCmds("D=M")
@@ -97,14 +365,7 @@ func (cw *CodeWriter) writePush(cmd parser.Command) error {
 		// If offset is <=3 some optimisation is possible
 		if cmd.Arg2 <= 3 {
 			cw.asm.SegmentAinstr(cmd.Arg1)
-			if cmd.Arg2 == 0 {
-				cw.asm.AsmCmds("A=M")
-			} else {
-				cw.asm.AsmCmds("A=M+1")
-			}
-			for i := 0; i < cmd.Arg2-1; i++ {
-				cw.asm.AsmCmds("A=A+1")
-			}
+			cw.segmentOffset(cmd.Arg2)
 		} else {
 			cw.asm.AsmCmds(cmd.Arg2, "D=A")
 			cw.asm.SegmentAinstr(cmd.Arg1)
@@ -112,55 +373,95 @@ func (cw *CodeWriter) writePush(cmd parser.Command) error {
 		}
 		cw.asm.AsmCmds("D=M")
 	}
+}
 
-	cw.asm.ToStack("D")
-	_, err := cw.writer.WriteString(cw.asm.CodeAsm())
-	return err
+// segmentOffset adds instructions moving A from the address of a segment pointer
+// to the address of the segment variable with the offset
+func (cw *CodeWriter) segmentOffset(offset int) {
+	if offset == 0 {
+		cw.asm.AsmCmds("A=M")
+	} else {
+		cw.asm.AsmCmds("A=M+1")
+	}
+	for i := 0; i < offset-1; i++ {
+		cw.asm.AsmCmds("A=A+1")
+	}
 }
 
-func (cw *CodeWriter) writePop(cmd parser.Command) error {
-	cw.asm.AddComment(fmt.Sprintf("pop %s %d", cmd.Arg1, cmd.Arg2))
+// maxPopOffset is the max offset of a variable segment a pop reaches by incrementing A.
+// Addresses of larger offsets are calculated in R13 before the value is popped
+const maxPopOffset = 7
+
+// popToR13 reports if the address of a pop command is calculated in R13
+func popToR13(cmd parser.Command) bool {
+	_, ok := varSegments[cmd.Arg1]
+	return ok && cmd.Arg2 > maxPopOffset
+}
 
+// storePopValue adds instructions storing the D-register to the variable of a pop command.
+// If popToR13 is true, R13 must hold the address of the variable
+func (cw *CodeWriter) storePopValue(cmd parser.Command) {
 	switch {
 	case parser.IsStaticSegment(cmd.Arg1):
-		cw.asm.FromStack("D")
 		cw.asm.StaticAinstr(cw.stPrefix, cmd.Arg2)
-		cw.asm.AsmCmds("M=D")
 	case parser.IsTempSegment(cmd.Arg1):
-		cw.asm.FromStack("D")
 		cw.asm.TempAInstr(cmd.Arg2)
-		cw.asm.AsmCmds("M=D")
 	case parser.IsPointerSegment(cmd.Arg1):
-		cw.asm.FromStack("D")
 		cw.asm.PointerAinstr(cmd.Arg2)
-		cw.asm.AsmCmds("M=D")
+	case popToR13(cmd):
+		cw.asm.AsmCmds(r13, "A=M")
 	default:
-		if cmd.Arg2 <= 7 {
-			cw.asm.FromStack("D")
-			cw.asm.SegmentAinstr(cmd.Arg1)
-			if cmd.Arg2 == 0 {
-				cw.asm.AsmCmds("A=M")
-			} else {
-				cw.asm.AsmCmds("A=M+1")
-			}
-			for i := 0; i < cmd.Arg2-1; i++ {
-				cw.asm.AsmCmds("A=A+1")
-			}
-		} else {
-			cw.asm.AsmCmds(cmd.Arg2, "D=A")
-			cw.asm.SegmentAinstr(cmd.Arg1)
-			cw.asm.AsmCmds("D=D+M", r13, "M=D")
-			cw.asm.FromStack("D")
-			cw.asm.AsmCmds(r13, "A=M")
-		}
-		cw.asm.AsmCmds("M=D")
+		cw.asm.SegmentAinstr(cmd.Arg1)
+		cw.segmentOffset(cmd.Arg2)
 	}
-	_, err := cw.writer.WriteString(cw.asm.CodeAsm())
-	return err
+	cw.asm.AsmCmds("M=D")
+}
+
+// addressToR13 adds instructions calculating the address of a pop variable in R13
+func (cw *CodeWriter) addressToR13(cmd parser.Command) {
+	cw.asm.AsmCmds(cmd.Arg2, "D=A")
+	cw.asm.SegmentAinstr(cmd.Arg1)
+	cw.asm.AsmCmds("D=D+M", r13, "M=D")
+}
+
+func (cw *CodeWriter) writePop(cmd parser.Command) error {
+	cw.asm.AddComment(fmt.Sprintf("pop %s %d", cmd.Arg1, cmd.Arg2))
+	// The address in R13 is calculated with the D-register
+	if popToR13(cmd) {
+		cw.spill()
+		cw.addressToR13(cmd)
+	}
+	if !cw.cached {
+		cw.asm.FromStack("D")
+	}
+	cw.storePopValue(cmd)
+	cw.cached = false
+	return cw.emit()
+}
+
+// WritePushPop writes a push immediately followed by a pop as a move through
+// the D-register and R13 without touching the stack
+func (cw *CodeWriter) WritePushPop(push, pop parser.Command) error {
+	if push.CmdType != parser.CmdPush || pop.CmdType != parser.CmdPop {
+		return fmt.Errorf("Only a push and a pop can be fused")
+	}
+	cw.spill()
+	cw.asm.AddComment(fmt.Sprintf("push %s %d, pop %s %d", push.Arg1, push.Arg2, pop.Arg1, pop.Arg2))
+	if popToR13(pop) {
+		cw.addressToR13(pop)
+	}
+	cw.loadPushValue(push)
+	cw.storePopValue(pop)
+	return cw.emit()
 }
 
 func (cw *CodeWriter) writeAritmBinary(cmd parser.Command) error {
 	cw.asm.AddComment(cmd.Arg1)
+	if cw.cached {
+		// y is in D, x is popped. The result stays in D
+		cw.asm.AsmCmds(sp, "AM=M-1", cachedBinaryComps[cmd.Arg1])
+		return cw.emit()
+	}
 	cw.asm.FromStack("D")
 	cw.asm.AsmCmds("A=A-1")
 	switch cmd.Arg1 {
@@ -173,12 +474,15 @@ func (cw *CodeWriter) writeAritmBinary(cmd parser.Command) error {
 	case parser.OrKey:
 		cw.asm.AsmCmds("M=D|M")
 	}
-	_, err := cw.writer.WriteString(cw.asm.CodeAsm())
-	return err
+	return cw.emit()
 }
 
 func (cw *CodeWriter) writeArithmUnary(cmd parser.Command) error {
 	cw.asm.AddComment(cmd.Arg1)
+	if cw.cached {
+		cw.asm.AsmCmds(cachedUnaryComps[cmd.Arg1])
+		return cw.emit()
+	}
 	// Get address for result (top of the stack)
 	cw.asm.AsmCmds(sp, "A=M-1")
 	// make calculation
@@ -188,57 +492,53 @@ func (cw *CodeWriter) writeArithmUnary(cmd parser.Command) error {
 	case parser.NotKey:
 		cw.asm.AsmCmds("M=!M")
 	}
-	_, err := cw.writer.WriteString(cw.asm.CodeAsm())
-	return err
+	return cw.emit()
 }
 
 func (cw *CodeWriter) writeArithmCond(cmd parser.Command) error {
 	cw.asm.AddComment(cmd.Arg1)
-	// Get boolean from stack to D-register
-	cw.asm.FromStack("D")
-	// By default set to false
-	cw.asm.AsmCmds("A=A-1", "D=M-D", "M=0")
-	// Set label to jump if condition is true
-	cw.asm.AtArithmCondLabel(cw.stPrefix, cmd.Arg1, cw.arCondCount)
-
-	switch cmd.Arg1 {
-	case parser.EqKey:
-		cw.asm.AsmCmds("D;JNE") // if D=M-D != 0 than jump to the end and leave M=false
-	case parser.GtKey:
-		cw.asm.AsmCmds("D;JLE") // if D=M-D <=0 then jump to the end and leave M=false
-	case parser.LtKey:
-		cw.asm.AsmCmds("D;JGE") // if D=M-D >= 0 then jump to the end and leave M=false
+	// static.EQ_END_5
+	idx := cw.arCondCount
+	label := func(part string) string {
+		return fmt.Sprintf("%s.%s_%s_%d", cw.stPrefix, strings.ToUpper(cmd.Arg1), part, idx)
 	}
-	// Set true
-	cw.asm.AsmCmds(sp, "A=M-1", "M=-1")
-	cw.asm.SetArithmCondLabel(cw.stPrefix, cmd.Arg1, cw.arCondCount)
+	endLabel := label("END")
 	cw.arCondCount++
-	_, err := cw.writer.WriteString(cw.asm.CodeAsm())
-	return err
+	if cw.opts.SharedCompare {
+		// The end label is the return address
+		cw.asm.AtLabel(endLabel)
+		cw.asm.AsmCmds("D=A")
+		cw.asm.AtLabel(compareLabel(cmd.Arg1))
+		cw.asm.AsmCmds("0;JMP")
+		cw.asm.SetLabel(endLabel)
+	} else {
+		cw.writeCompareSequence(cmd.Arg1, label)
+	}
+	return cw.emit()
 }
 
 func (cw *CodeWriter) writeGotoCmd(cmd parser.Command) error {
 	cw.asm.AddComment("goto " + cmd.Arg1)
 	cw.asm.AtFuncLabel(cw.fnPrefix, cmd.Arg1)
 	cw.asm.AsmCmds("0;JMP")
-	_, err := cw.writer.WriteString(cw.asm.CodeAsm())
-	return err
+	return cw.emit()
 }
 
 func (cw *CodeWriter) writeLabelCmd(cmd parser.Command) error {
 	cw.asm.AddComment("label " + cmd.Arg1)
 	cw.asm.SetFuncLabel(cw.fnPrefix, cmd.Arg1)
-	_, err := cw.writer.WriteString(cw.asm.CodeAsm())
-	return err
+	return cw.emit()
 }
 
 func (cw *CodeWriter) writeIfGotoCmd(cmd parser.Command) error {
 	cw.asm.AddComment("if-goto " + cmd.Arg1)
-	cw.asm.FromStack("D")
+	if !cw.cached {
+		cw.asm.FromStack("D")
+	}
+	cw.cached = false
 	cw.asm.AtFuncLabel(cw.fnPrefix, cmd.Arg1)
 	cw.asm.AsmCmds("D;JNE")
-	_, err := cw.writer.WriteString(cw.asm.CodeAsm())
-	return err
+	return cw.emit()
 }
 
 func (cw *CodeWriter) writeFunctionCmd(cmd parser.Command) error {
@@ -262,8 +562,7 @@ func (cw *CodeWriter) writeFunctionCmd(cmd parser.Command) error {
 		// Restore the right position in SP
 		cw.asm.AsmCmds("D=A+1", "@SP", "M=D")
 	}
-	_, err := cw.writer.WriteString(cw.asm.CodeAsm())
-	return err
+	return cw.emit()
 }
 
 func (cw *CodeWriter) writeCallCmd(cmd parser.Command) error {
@@ -272,6 +571,24 @@ func (cw *CodeWriter) writeCallCmd(cmd parser.Command) error {
 	label := fmt.Sprintf("%s.CALL_RET_%d", cw.stPrefix, cw.callCount)
 	cw.callCount++
 
+	if cw.opts.CompactCalls {
+		// R13 = <func args>. Small numbers are set without the D-register
+		if cmd.Arg2 <= 1 {
+			cw.asm.AsmCmds(r13, fmt.Sprintf("M=%d", cmd.Arg2))
+		} else {
+			cw.asm.AsmCmds(cmd.Arg2, "D=A", r13, "M=D")
+		}
+		// R14 = address of the function, D = return address
+		cw.asm.AtLabel(cmd.Arg1)
+		cw.asm.AsmCmds("D=A", r14, "M=D")
+		cw.asm.AtLabel(label)
+		cw.asm.AsmCmds("D=A")
+		cw.asm.AtLabel(callLabel)
+		cw.asm.AsmCmds("0;JMP")
+		cw.asm.SetLabel(label)
+		return cw.emit()
+	}
+
 	// Add redturnAddr to stack but do not move SP Pointer
 	cw.asm.AtLabel(label)
 	cw.asm.AsmCmds("D=A", sp, "A=M", "M=D")
@@ -293,12 +610,65 @@ func (cw *CodeWriter) writeCallCmd(cmd parser.Command) error {
 	// Label of return address
 	cw.asm.SetLabel(label)
 
-	_, err := cw.writer.WriteString(cw.asm.CodeAsm())
-	return err
+	return cw.emit()
+}
+
+// WriteTailCall writes a call immediately followed by return. The callee reuses the frame
+// of the current function: the saved frame of the caller is moved right after the args
+// of the current function, the new args are moved to ARG and the callee returns straight
+// to the caller. The current function must be called with at least as many args as
+// the callee takes, so nothing is overwritten before it is moved
+func (cw *CodeWriter) WriteTailCall(call parser.Command) error {
+	if call.CmdType != parser.CmdCall {
+		return fmt.Errorf("Only a call can be a tail call")
+	}
+	cw.spill()
+	cw.asm.AddComment(fmt.Sprintf("call %s %d, return", call.Arg1, call.Arg2))
+	// R13 = ARG+<args>-1. The frame is moved up from LCL-5 to R13+1
+	cw.asm.AsmCmds(arg, "D=M")
+	if call.Arg2 == 0 {
+		cw.asm.AsmCmds("D=D-1")
+	} else if call.Arg2 > 1 {
+		cw.asm.AsmCmds(call.Arg2-1, "D=D+A")
+	}
+	cw.asm.AsmCmds(r13, "M=D")
+	for k := 5; k > 0; k-- {
+		if k == 1 {
+			cw.asm.AsmCmds(lcl, "A=M-1", "D=M")
+		} else {
+			cw.asm.AsmCmds(k, "D=A", lcl, "A=M-D", "D=M")
+		}
+		cw.asm.AsmCmds(r13, "AM=M+1", "M=D")
+	}
+	// Move the args from the top of the stack to ARG, the last one first.
+	// R13 = ARG+<args>
+	if call.Arg2 > 0 {
+		cw.asm.AsmCmds(call.Arg2, "D=A", arg, "D=D+M", r13, "M=D")
+		for i := 0; i < call.Arg2; i++ {
+			cw.asm.FromStack("D")
+			cw.asm.AsmCmds(r13, "AM=M-1", "M=D")
+		}
+	}
+	// SP = LCL = ARG+<args>+5
+	cw.asm.AsmCmds(arg, "D=M", call.Arg2+5, "D=D+A", sp, "M=D", lcl, "M=D")
+	cw.asm.AtLabel(call.Arg1)
+	cw.asm.AsmCmds("0;JMP")
+	return cw.emit()
 }
 
 func (cw *CodeWriter) writeReturnCmd(cmd parser.Command) error {
 	cw.asm.AddComment("return")
+	if cw.opts.CompactCalls {
+		cw.asm.AtLabel(returnLabel)
+		cw.asm.AsmCmds("0;JMP")
+	} else {
+		cw.writeReturnSequence()
+	}
+	return cw.emit()
+}
+
+// writeReturnSequence adds the instructions of the return command
+func (cw *CodeWriter) writeReturnSequence() {
 	// Save return address. R14 = *(EndFrame - 5)
 	cw.asm.AsmCmds(5, "D=A", lcl, "A=M-D", "D=M", "@R14", "M=D")
 	// Move return value to arg. *ARG = Pop()
@@ -313,7 +683,4 @@ func (cw *CodeWriter) writeReturnCmd(cmd parser.Command) error {
 	}
 	// Jump to return address
 	cw.asm.AsmCmds("@R14", "A=M", "0;JMP")
-
-	_, err := cw.writer.WriteString(cw.asm.CodeAsm())
-	return err
 }
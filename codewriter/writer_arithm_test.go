@@ -1,6 +1,8 @@
 package codewriter
 
 import (
+	"bufio"
+	"strings"
 	"testing"
 
 	"github.com/verybigtuple/hackvmtranslator/parser"
@@ -75,13 +77,39 @@ func TestWriterGt(t *testing.T) {
 		"@SP",
 		"AM=M-1",
 		"D=M", // D = y
+		"@test.GT_YNEG_0",
+		"D;JLT",
 
+		"@SP", // y >= 0
+		"A=M-1",
+		"D=M", // D = x
+		"@test.GT_DIFF_0",
+		"D;JLT", // x < 0 <= y, D = x < 0
+
+		"(test.GT_SAME_0)", // x-y cannot overflow if x and y have the same sign
+		"@SP",
+		"A=M",
+		"D=M",
 		"A=A-1",
-		"D=M-D", // M=x; D=x-y. If (x > y), then x-y > 0
-		"M=0",   // False by default
+		"D=M-D", // D = x-y
+		"@test.GT_DIFF_0",
+		"0;JMP",
+
+		"(test.GT_YNEG_0)", // y < 0
+		"@SP",
+		"A=M-1",
+		"D=M", // D = x
+		"@test.GT_SAME_0",
+		"D;JLT",
+		"D=1", // y < 0 <= x, D = 1 > 0
+
+		"(test.GT_DIFF_0)",
+		"@SP",
+		"A=M-1",
+		"M=0", // False by default
 
 		"@test.GT_END_0",
-		"D;JLE", // If D=x-y <= 0 then jump to end and leave M=False, else set true (-1)
+		"D;JLE", // If D <= 0 then jump to end and leave M=False, else set true (-1)
 
 		"@SP",
 		"A=M-1",
@@ -98,13 +126,39 @@ func TestWriterLt(t *testing.T) {
 		"@SP",
 		"AM=M-1",
 		"D=M", // D = y
+		"@test.LT_YNEG_0",
+		"D;JLT",
+
+		"@SP", // y >= 0
+		"A=M-1",
+		"D=M", // D = x
+		"@test.LT_DIFF_0",
+		"D;JLT", // x < 0 <= y, D = x < 0
 
+		"(test.LT_SAME_0)", // x-y cannot overflow if x and y have the same sign
+		"@SP",
+		"A=M",
+		"D=M",
 		"A=A-1",
-		"D=M-D", // M=x; D=x-y. If (x > y), then x-y < 0
-		"M=0",   // False by default
+		"D=M-D", // D = x-y
+		"@test.LT_DIFF_0",
+		"0;JMP",
+
+		"(test.LT_YNEG_0)", // y < 0
+		"@SP",
+		"A=M-1",
+		"D=M", // D = x
+		"@test.LT_SAME_0",
+		"D;JLT",
+		"D=1", // y < 0 <= x, D = 1 > 0
+
+		"(test.LT_DIFF_0)",
+		"@SP",
+		"A=M-1",
+		"M=0", // False by default
 
 		"@test.LT_END_0",
-		"D;JGE", // If D=x-y >= 0 then jump and leave M=False, esle set true (-1)
+		"D;JGE", // If D >= 0 then jump and leave M=False, esle set true (-1)
 
 		"@SP",
 		"A=M-1",
@@ -152,3 +206,53 @@ func TestWriterNot(t *testing.T) {
 	}
 	runTestLine(t, testLine, want)
 }
+
+func TestWriterEqShared(t *testing.T) {
+	testLine := parser.Command{CmdType: parser.CmdArithmeticCond, Arg1: "eq"}
+	want := []string{
+		"// eq",
+		"@test.EQ_END_0", // Return address
+		"D=A",
+		"@$$EQ",
+		"0;JMP",
+		"(test.EQ_END_0)",
+	}
+	runTestLineOpts(t, testLine, Options{SharedCompare: true}, want)
+}
+
+func TestWriterCacheTOS(t *testing.T) {
+	cmds := []parser.Command{
+		{CmdType: parser.CmdPush, Arg1: "local", Arg2: 0},
+		{CmdType: parser.CmdPush, Arg1: "constant", Arg2: 1},
+		{CmdType: parser.CmdArithmeticBinary, Arg1: "add"},
+		{CmdType: parser.CmdArithmeticUnary, Arg1: "neg"},
+		{CmdType: parser.CmdIfGoto, Arg1: "LOOP"},
+		{CmdType: parser.CmdPush, Arg1: "temp", Arg2: 2},
+		{CmdType: parser.CmdLabel, Arg1: "END"},
+	}
+	want := []string{
+		"// push local 0", "@LCL", "A=M", "D=M",
+		"// push constant 1", "@SP", "M=M+1", "A=M-1", "M=D", "D=1",
+		"// add", "@SP", "AM=M-1", "D=D+M",
+		"// neg", "D=-D",
+		"// if-goto LOOP", "@func$LOOP", "D;JNE",
+		"// push temp 2", "@7", "D=M",
+		"@SP", "M=M+1", "A=M-1", "M=D", "// label END", "(func$END)",
+	}
+	sb := strings.Builder{}
+	writer := bufio.NewWriter(&sb)
+	codeWriter := NewCodeWriter(writer, "", "test", "func")
+	codeWriter.SetOptions(Options{CacheTOS: true})
+	for _, cmd := range cmds {
+		if err := codeWriter.WriteCommand(cmd); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	if err := codeWriter.Flush(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	writer.Flush()
+	if actual := strings.TrimSuffix(sb.String(), "\n"); actual != strings.Join(want, "\n") {
+		t.Errorf("Actual:\n%s\nwant:\n%s", actual, strings.Join(want, "\n"))
+	}
+}
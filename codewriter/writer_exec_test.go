@@ -0,0 +1,287 @@
+package codewriter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/verybigtuple/hackvmtranslator/emulator"
+	"github.com/verybigtuple/hackvmtranslator/parser"
+)
+
+// Initial values of the segment pointers for the execution tests
+const (
+	execSP   = 256
+	execLCL  = 300
+	execARG  = 400
+	execTHIS = 3000
+	execTHAT = 3010
+)
+
+// execModes are the options every execution test runs with
+var execModes = []struct {
+	desc string
+	opts Options
+}{
+	{"Default", Options{}},
+	{"Compact", Options{CompactCalls: true}},
+	{"SharedCompare", Options{SharedCompare: true}},
+	{"Peephole", Options{Peephole: PeepholeAll}},
+	{"CacheTOS", Options{CacheTOS: true}},
+	{"All", Options{CompactCalls: true, SharedCompare: true, Peephole: PeepholeAll, CacheTOS: true}},
+}
+
+// runVMCode translates VM code, runs it on the emulator and returns the CPU for inspection
+func runVMCode(t *testing.T, vm string) *emulator.CPU {
+	t.Helper()
+	return runVMCodeOpts(t, vm, Options{})
+}
+
+// runVMCodeOpts is runVMCode with the given options. The runtime is written after the code
+func runVMCodeOpts(t *testing.T, vm string, opts Options) *emulator.CPU {
+	t.Helper()
+
+	sb := strings.Builder{}
+	writer := bufio.NewWriter(&sb)
+	codeWriter := NewCodeWriter(writer, "", "test", "func")
+	codeWriter.SetOptions(opts)
+	p := parser.NewParser(bufio.NewReader(strings.NewReader(vm)))
+	for {
+		cmd, err := p.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Parser error %v", err)
+		}
+		if err := codeWriter.WriteCommand(*cmd); err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+	if err := codeWriter.WriteRuntime(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := codeWriter.Flush(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	writer.Flush()
+
+	cpu, _, err := emulator.NewFromAsm(strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatalf("Assembler error %v", err)
+	}
+	cpu.RAM[0] = execSP
+	cpu.RAM[1] = execLCL
+	cpu.RAM[2] = execARG
+	cpu.RAM[3] = execTHIS
+	cpu.RAM[4] = execTHAT
+	if err := cpu.Run(100000); err != nil {
+		t.Fatalf("Emulator error %v", err)
+	}
+	return cpu
+}
+
+// checkStack checks SP and the values on the stack
+func checkStack(t *testing.T, cpu *emulator.CPU, want ...int16) {
+	t.Helper()
+	if int(cpu.RAM[0]) != execSP+len(want) {
+		t.Errorf("SP: actual %d; want %d", cpu.RAM[0], execSP+len(want))
+		return
+	}
+	for i, w := range want {
+		if cpu.RAM[execSP+i] != w {
+			t.Errorf("RAM[%d]: actual %d; want %d", execSP+i, cpu.RAM[execSP+i], w)
+		}
+	}
+}
+
+func TestExecArithmetic(t *testing.T) {
+	testCases := []struct {
+		vm   string
+		want int16
+	}{
+		{"push constant 7\npush constant 8\nadd", 15},
+		{"push constant 7\npush constant 8\nsub", -1},
+		{"push constant 12\npush constant 10\nand", 8},
+		{"push constant 12\npush constant 10\nor", 14},
+		{"push constant 5\nneg", -5},
+		{"push constant 0\nnot", -1},
+		{"push constant 32767\npush constant 1\nadd", -32768},
+		{"push constant 17\npush constant 17\neq", -1},
+		{"push constant 17\npush constant 16\neq", 0},
+		{"push constant 892\npush constant 891\ngt", -1},
+		{"push constant 891\npush constant 892\ngt", 0},
+		{"push constant 891\npush constant 891\ngt", 0},
+		{"push constant 891\npush constant 892\nlt", -1},
+		{"push constant 892\npush constant 891\nlt", 0},
+		{"push constant 891\npush constant 891\nlt", 0},
+	}
+	for _, mode := range execModes {
+		for _, tc := range testCases {
+			t.Run(mode.desc+"/"+strings.ReplaceAll(tc.vm, "\n", "; "), func(t *testing.T) {
+				cpu := runVMCodeOpts(t, tc.vm, mode.opts)
+				checkStack(t, cpu, tc.want)
+			})
+		}
+	}
+}
+
+func TestExecCompareBoundaries(t *testing.T) {
+	// x-y overflows for most of the cases. neg and not make negative constants
+	testCases := []struct {
+		x, y   string
+		gt, lt int16
+	}{
+		{"push constant 32767", "push constant 2\nneg", -1, 0},
+		{"push constant 2\nneg", "push constant 32767", 0, -1},
+		{"push constant 32767\nnot", "push constant 1", 0, -1},
+		{"push constant 1", "push constant 32767\nnot", -1, 0},
+		{"push constant 0", "push constant 32767\nnot", -1, 0},
+		{"push constant 32767\nnot", "push constant 0", 0, -1},
+		{"push constant 32767", "push constant 32767\nnot", -1, 0},
+		{"push constant 32767\nnot", "push constant 32767", 0, -1},
+		{"push constant 32767\nnot", "push constant 32767\nnot", 0, 0},
+		{"push constant 1\nneg", "push constant 32767\nnot", -1, 0},
+		{"push constant 0", "push constant 0", 0, 0},
+	}
+	for _, mode := range execModes {
+		for _, tc := range testCases {
+			vm := tc.x + "\n" + tc.y + "\ngt\n" + tc.x + "\n" + tc.y + "\nlt"
+			t.Run(mode.desc+"/"+strings.ReplaceAll(vm, "\n", "; "), func(t *testing.T) {
+				cpu := runVMCodeOpts(t, vm, mode.opts)
+				checkStack(t, cpu, tc.gt, tc.lt)
+			})
+		}
+	}
+}
+
+func TestExecSeveralConditions(t *testing.T) {
+	vm := `
+	push constant 1
+	push constant 1
+	eq
+	push constant 1
+	push constant 2
+	eq
+	push constant 3
+	push constant 2
+	gt
+	push constant 2
+	push constant 3
+	lt
+	`
+	for _, mode := range execModes {
+		t.Run(mode.desc, func(t *testing.T) {
+			cpu := runVMCodeOpts(t, vm, mode.opts)
+			checkStack(t, cpu, -1, 0, -1, -1)
+		})
+	}
+}
+
+func TestExecPushPopSegments(t *testing.T) {
+	bases := map[string]int{
+		"local":    execLCL,
+		"argument": execARG,
+		"this":     execTHIS,
+		"that":     execTHAT,
+	}
+	for segm, base := range bases {
+		// Offsets cover both optimized and general code paths
+		for offset := 0; offset <= 10; offset++ {
+			t.Run(fmt.Sprintf("%s %d", segm, offset), func(t *testing.T) {
+				value := int16(100 + offset)
+				vm := fmt.Sprintf(
+					"push constant %d\npop %s %d\npush %s %d",
+					value, segm, offset, segm, offset,
+				)
+				cpu := runVMCode(t, vm)
+				if cpu.RAM[base+offset] != value {
+					t.Errorf("RAM[%d]: actual %d; want %d", base+offset, cpu.RAM[base+offset], value)
+				}
+				checkStack(t, cpu, value)
+			})
+		}
+	}
+}
+
+func TestExecPushPopFixedSegments(t *testing.T) {
+	vm := `
+	push constant 10
+	pop temp 0
+	push constant 11
+	pop temp 7
+	push constant 3030
+	pop pointer 0
+	push constant 3040
+	pop pointer 1
+	push constant 12
+	pop static 3
+	push temp 0
+	push temp 7
+	push pointer 0
+	push pointer 1
+	push static 3
+	`
+	cpu := runVMCode(t, vm)
+	if cpu.RAM[5] != 10 || cpu.RAM[12] != 11 {
+		t.Errorf("Temp: actual %d, %d; want 10, 11", cpu.RAM[5], cpu.RAM[12])
+	}
+	if cpu.RAM[3] != 3030 || cpu.RAM[4] != 3040 {
+		t.Errorf("Pointer: actual %d, %d; want 3030, 3040", cpu.RAM[3], cpu.RAM[4])
+	}
+	checkStack(t, cpu, 10, 11, 3030, 3040, 12)
+}
+
+func TestExecCallReturn(t *testing.T) {
+	for _, mode := range execModes {
+		t.Run(mode.desc, func(t *testing.T) {
+			cpu := runVMCodeOpts(t, callReturnProgram, mode.opts)
+			checkStack(t, cpu, 42)
+			if cpu.RAM[1] != execLCL || cpu.RAM[2] != execARG || cpu.RAM[3] != execTHIS || cpu.RAM[4] != execTHAT {
+				t.Errorf("Segments are not restored: %v", cpu.RAM[1:5])
+			}
+		})
+	}
+}
+
+const callReturnProgram = `
+	push constant 21
+	call Test.double 1
+	label END
+	goto END
+
+	function Test.double 2
+	push argument 0
+	pop local 1
+	push local 1
+	push argument 0
+	add
+	return
+	`
+
+func TestExecIfGoto(t *testing.T) {
+	// Sum of 1..5
+	vm := `
+	push constant 0
+	pop local 0
+	push constant 5
+	pop local 1
+	label LOOP
+	push local 0
+	push local 1
+	add
+	pop local 0
+	push local 1
+	push constant 1
+	sub
+	pop local 1
+	push local 1
+	if-goto LOOP
+	push local 0
+	`
+	cpu := runVMCode(t, vm)
+	checkStack(t, cpu, 15)
+}
@@ -170,3 +170,53 @@ func TestFuncReturn(t *testing.T) {
 	}
 	runTestLine(t, testLine, want)
 }
+
+func TestFuncCallCompact(t *testing.T) {
+	testLine := parser.Command{CmdType: parser.CmdCall, Arg1: "Test.func", Arg2: 2}
+	want := []string{
+		"// call Test.func 2",
+		"@2", // R13 = args
+		"D=A",
+		"@R13",
+		"M=D",
+		"@Test.func", // R14 = function
+		"D=A",
+		"@R14",
+		"M=D",
+		"@test.CALL_RET_0", // D = return address
+		"D=A",
+		"@$$CALL",
+		"0;JMP",
+		"(test.CALL_RET_0)",
+	}
+	runTestLineOpts(t, testLine, Options{CompactCalls: true}, want)
+}
+
+func TestFuncCallCompactNoArgs(t *testing.T) {
+	testLine := parser.Command{CmdType: parser.CmdCall, Arg1: "Test.func", Arg2: 0}
+	want := []string{
+		"// call Test.func 0",
+		"@R13",
+		"M=0",
+		"@Test.func",
+		"D=A",
+		"@R14",
+		"M=D",
+		"@test.CALL_RET_0",
+		"D=A",
+		"@$$CALL",
+		"0;JMP",
+		"(test.CALL_RET_0)",
+	}
+	runTestLineOpts(t, testLine, Options{CompactCalls: true}, want)
+}
+
+func TestFuncReturnCompact(t *testing.T) {
+	testLine := parser.Command{CmdType: parser.CmdReturn}
+	want := []string{
+		"// return",
+		"@$$RETURN",
+		"0;JMP",
+	}
+	runTestLineOpts(t, testLine, Options{CompactCalls: true}, want)
+}
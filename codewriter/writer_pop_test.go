@@ -1,6 +1,8 @@
 package codewriter
 
 import (
+	"bufio"
+	"strings"
 	"testing"
 
 	"github.com/verybigtuple/hackvmtranslator/parser"
@@ -146,3 +148,65 @@ func TestWriterPopPointerOne(t *testing.T) {
 	}
 	runTestLine(t, testLine, want)
 }
+
+func TestWriterPushPopFused(t *testing.T) {
+	testCases := []struct {
+		desc      string
+		push, pop parser.Command
+		want      []string
+	}{
+		{
+			"Constant to temp",
+			parser.Command{CmdType: parser.CmdPush, Arg1: "constant", Arg2: 5},
+			parser.Command{CmdType: parser.CmdPop, Arg1: "temp", Arg2: 1},
+			[]string{"// push constant 5, pop temp 1", "@5", "D=A", "@6", "M=D"},
+		},
+		{
+			"True to temp",
+			parser.Command{CmdType: parser.CmdPush, Arg1: "constant", Arg2: -1},
+			parser.Command{CmdType: parser.CmdPop, Arg1: "temp", Arg2: 1},
+			[]string{"// push constant -1, pop temp 1", "D=-1", "@6", "M=D"},
+		},
+		{
+			"Local to that",
+			parser.Command{CmdType: parser.CmdPush, Arg1: "local", Arg2: 2},
+			parser.Command{CmdType: parser.CmdPop, Arg1: "that", Arg2: 0},
+			[]string{"// push local 2, pop that 0", "@LCL", "A=M+1", "A=A+1", "D=M", "@THAT", "A=M", "M=D"},
+		},
+		{
+			"Static to a large offset",
+			parser.Command{CmdType: parser.CmdPush, Arg1: "static", Arg2: 3},
+			parser.Command{CmdType: parser.CmdPop, Arg1: "argument", Arg2: 8},
+			[]string{
+				"// push static 3, pop argument 8",
+				"@8", "D=A", "@ARG", "D=D+M", "@R13", "M=D",
+				"@test.3", "D=M",
+				"@R13", "A=M", "M=D",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			sb := strings.Builder{}
+			writer := bufio.NewWriter(&sb)
+			codeWriter := NewCodeWriter(writer, "", "test", "func")
+			if err := codeWriter.WritePushPop(tc.push, tc.pop); err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			writer.Flush()
+			want := strings.Join(tc.want, "\n") + "\n"
+			if sb.String() != want {
+				t.Errorf("Actual:\n%s\nwant:\n%s", sb.String(), want)
+			}
+		})
+	}
+}
+
+func TestWriterPushPopNotFusable(t *testing.T) {
+	sb := strings.Builder{}
+	codeWriter := NewCodeWriter(bufio.NewWriter(&sb), "", "test", "func")
+	push := parser.Command{CmdType: parser.CmdPush, Arg1: "constant", Arg2: 5}
+	if err := codeWriter.WritePushPop(push, push); err == nil {
+		t.Errorf("Error is expected for two pushes")
+	}
+}
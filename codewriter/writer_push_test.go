@@ -2,6 +2,7 @@ package codewriter
 
 import (
 	"bufio"
+	"fmt"
 	"strings"
 	"testing"
 
@@ -9,15 +10,24 @@ import (
 )
 
 func runTestLine(t *testing.T, tc parser.Command, want []string) {
+	runTestLineOpts(t, tc, Options{}, want)
+}
+
+func runTestLineOpts(t *testing.T, tc parser.Command, opts Options, want []string) {
 	sb := strings.Builder{}
 	writer := bufio.NewWriter(&sb)
 
 	codeWriter := NewCodeWriter(writer, "", "test", "func")
+	codeWriter.SetOptions(opts)
 	err := codeWriter.WriteCommand(tc)
 	if err != nil {
 		t.Errorf("Unexpected error %v", err)
 		return
 	}
+	if err := codeWriter.Flush(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+		return
+	}
 	writer.Flush()
 
 	splitFunc := func(r rune) bool {
@@ -53,6 +63,62 @@ func TestWriterPushConst(t *testing.T) {
 	runTestLine(t, testLine, want)
 }
 
+func TestWriterPushConstSmall(t *testing.T) {
+	for _, v := range []int{0, 1, -1} {
+		testLine := parser.Command{CmdType: parser.CmdPush, Arg1: "constant", Arg2: v}
+		want := []string{
+			fmt.Sprintf("// push constant %d", v),
+			"@SP",
+			"M=M+1",
+			"A=M-1",
+			fmt.Sprintf("M=%d", v),
+		}
+		runTestLine(t, testLine, want)
+	}
+}
+
+func TestWriterPushConstMax(t *testing.T) {
+	testLine := parser.Command{CmdType: parser.CmdPush, Arg1: "constant", Arg2: 32767}
+	want := []string{
+		"// push constant 32767",
+		"@32767",
+		"D=A",
+		"@SP",
+		"M=M+1",
+		"A=M-1",
+		"M=D",
+	}
+	runTestLine(t, testLine, want)
+}
+
+func TestWriterPushConstNegative(t *testing.T) {
+	testLine := parser.Command{CmdType: parser.CmdPush, Arg1: "constant", Arg2: -7}
+	want := []string{
+		"// push constant -7",
+		"@7",
+		"D=-A",
+		"@SP",
+		"M=M+1",
+		"A=M-1",
+		"M=D",
+	}
+	runTestLine(t, testLine, want)
+}
+
+func TestWriterPushConstMin(t *testing.T) {
+	testLine := parser.Command{CmdType: parser.CmdPush, Arg1: "constant", Arg2: -32768}
+	want := []string{
+		"// push constant -32768",
+		"@32767",
+		"D=!A",
+		"@SP",
+		"M=M+1",
+		"A=M-1",
+		"M=D",
+	}
+	runTestLine(t, testLine, want)
+}
+
 func TestWriterPushStatic(t *testing.T) {
 	testLine := parser.Command{CmdType: parser.CmdPush, Arg1: "static", Arg2: 5}
 	want := []string{
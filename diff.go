@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/verybigtuple/hackvmtranslator/difftest"
+	"github.com/verybigtuple/hackvmtranslator/translator"
+)
+
+// runDiff runs the program in the VM interpreter and in the CPU emulator and compares the states
+func runDiff(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	noBootstrap := fs.Bool("nb", false, "Run without the bootstrapping code. SP is set to 256")
+	checkpoints := fs.String("checkpoints", "", "Comma separated functions; states are compared on every entry")
+	maxSteps := fs.Int("steps", difftest.DefaultMaxSteps, "Max number of VM commands")
+	fs.Parse(args)
+
+	if fs.Arg(0) == "" {
+		fmt.Fprintln(os.Stderr, "Argument Error: Input file/folder is not set")
+		return 1
+	}
+
+	opts := difftest.Options{
+		Translator: translator.Options{NoBootstrap: *noBootstrap},
+		MaxSteps:   *maxSteps,
+	}
+	if *checkpoints != "" {
+		opts.Checkpoints = strings.Split(*checkpoints, ",")
+	}
+
+	rep, err := difftest.RunPath(context.Background(), fs.Arg(0), opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 3
+	}
+	fmt.Printf(
+		"OK: %d checkpoints, %d VM commands, %d CPU instructions\n",
+		rep.Checkpoints, rep.Steps, rep.Cycles,
+	)
+	return 0
+}
@@ -0,0 +1,359 @@
+// Package difftest runs a VM program both in the VM interpreter and, translated to asm,
+// in the Hack CPU emulator, and compares the machine states
+package difftest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/verybigtuple/hackvmtranslator/assembler"
+	"github.com/verybigtuple/hackvmtranslator/emulator"
+	"github.com/verybigtuple/hackvmtranslator/interpreter"
+	"github.com/verybigtuple/hackvmtranslator/parser"
+	"github.com/verybigtuple/hackvmtranslator/translator"
+)
+
+// Default limits
+const (
+	DefaultMaxSteps  = 1000000
+	DefaultMaxCycles = 50000000
+)
+
+// Compared memory regions. The stack above SP is not compared since it keeps garbage
+// that differs: e.g. return addresses are ROM addresses in asm and command indexes in VM
+const (
+	tempFirst  = interpreter.TempBaseAddr
+	tempLast   = interpreter.TempBaseAddr + 7
+	heapFirst  = 2048
+	heapLast   = 24575
+	maxReports = 20
+)
+
+// Options of a differential run
+type Options struct {
+	Translator  translator.Options
+	Init        map[int]int16 // Initial RAM values for both machines
+	MaxSteps    int           // Limit of VM commands
+	MaxCycles   int           // Limit of CPU instructions
+	Checkpoints []string      // States are also compared on every entry to these functions
+}
+
+// Mismatch describes different machine states
+type Mismatch struct {
+	Checkpoint string // Function name or "end"
+	Hit        int    // Number of the checkpoint hit
+	Diffs      []string
+}
+
+func (m *Mismatch) Error() string {
+	return fmt.Sprintf(
+		"State mismatch at %s (hit %d):\n%s",
+		m.Checkpoint, m.Hit, strings.Join(m.Diffs, "\n"),
+	)
+}
+
+// Report is the result of a successful run
+type Report struct {
+	Checkpoints int // Number of compared checkpoints
+	Steps       int // Executed VM commands
+	Cycles      int // Executed CPU instructions
+}
+
+type source struct {
+	path string
+	data []byte
+}
+
+type runner struct {
+	opts Options
+	vm   *interpreter.Machine
+	cpu  *emulator.CPU
+	prog *assembler.Program
+
+	files       []string
+	checkpoints map[uint16]string
+	vmAtPoint   bool // Machines stopped at a checkpoint and must leave it first
+	cpuAtPoint  bool
+}
+
+// Run compares the program states after the end of the execution and at checkpoints.
+// A state mismatch is returned as *Mismatch
+func Run(ctx context.Context, inputs []translator.Input, opts Options) (*Report, error) {
+	if opts.MaxSteps == 0 {
+		opts.MaxSteps = DefaultMaxSteps
+	}
+	if opts.MaxCycles == 0 {
+		opts.MaxCycles = DefaultMaxCycles
+	}
+
+	sources, err := readSources(inputs)
+	if err != nil {
+		return nil, err
+	}
+	r := &runner{opts: opts, checkpoints: make(map[uint16]string)}
+	if err := r.load(ctx, sources); err != nil {
+		return nil, err
+	}
+
+	rep := &Report{}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		vmPoint, err := r.runVM()
+		if err != nil {
+			return nil, fmt.Errorf("Interpreter: %w", err)
+		}
+		cpuPoint, err := r.runCPU()
+		if err != nil {
+			return nil, fmt.Errorf("Emulator: %w", err)
+		}
+		rep.Checkpoints++
+		rep.Steps, rep.Cycles = r.vm.Steps, r.cpu.Cycles
+
+		if vmPoint != cpuPoint {
+			return nil, &Mismatch{
+				Checkpoint: vmPoint,
+				Hit:        rep.Checkpoints,
+				Diffs:      []string{fmt.Sprintf("Emulator is at %s", cpuPoint)},
+			}
+		}
+		if diffs := r.compare(); len(diffs) > 0 {
+			return nil, &Mismatch{Checkpoint: vmPoint, Hit: rep.Checkpoints, Diffs: diffs}
+		}
+		if vmPoint == "end" {
+			return rep, nil
+		}
+	}
+}
+
+// RunPath runs all *.vm files of the path
+func RunPath(ctx context.Context, path string, opts Options) (*Report, error) {
+	paths, err := translator.InputFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	inputs := make([]translator.Input, len(paths))
+	for i, p := range paths {
+		inputs[i] = translator.Input{Path: p}
+	}
+	return Run(ctx, inputs, opts)
+}
+
+func readSources(inputs []translator.Input) ([]source, error) {
+	sources := make([]source, 0, len(inputs))
+	for _, in := range inputs {
+		var data []byte
+		var err error
+		if in.Reader != nil {
+			data, err = ioutil.ReadAll(in.Reader)
+		} else {
+			data, err = ioutil.ReadFile(in.Path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source{in.Path, data})
+	}
+	// The same order as the translator uses
+	sort.SliceStable(sources, func(i, j int) bool {
+		return filepath.Base(sources[i].path) < filepath.Base(sources[j].path)
+	})
+	return sources, nil
+}
+
+func (r *runner) load(ctx context.Context, sources []source) error {
+	files := make([]interpreter.File, 0, len(sources))
+	inputs := make([]translator.Input, 0, len(sources))
+	for _, s := range sources {
+		base := filepath.Base(s.path)
+		name := strings.TrimSuffix(base, filepath.Ext(base))
+		cmds, err := parseAll(s.data)
+		if err != nil {
+			return fmt.Errorf("File %s: %w", s.path, err)
+		}
+		files = append(files, interpreter.File{Name: name, Commands: cmds})
+		inputs = append(inputs, translator.Input{Path: s.path, Reader: strings.NewReader(string(s.data))})
+		r.files = append(r.files, name)
+	}
+
+	vm, err := interpreter.New(files)
+	if err != nil {
+		return err
+	}
+	res, err := translator.Translate(ctx, inputs, r.opts.Translator)
+	if err != nil {
+		if res != nil && len(res.Diagnostics) > 0 {
+			return res.Diagnostics[0]
+		}
+		return err
+	}
+	cpu, prog, err := emulator.NewFromAsm(strings.NewReader(res.Asm))
+	if err != nil {
+		return err
+	}
+	r.vm, r.cpu, r.prog = vm, cpu, prog
+
+	for _, fn := range r.opts.Checkpoints {
+		if addr, ok := prog.Labels[fn]; ok {
+			r.checkpoints[addr] = fn
+		}
+	}
+
+	if r.opts.Translator.NoBootstrap {
+		if _, ok := r.opts.Init[interpreter.SPAddr]; !ok {
+			r.vm.RAM[interpreter.SPAddr] = interpreter.StackBase
+			r.cpu.RAM[interpreter.SPAddr] = interpreter.StackBase
+		}
+	} else if err := r.vm.Bootstrap(); err != nil {
+		return err
+	}
+	for addr, v := range r.opts.Init {
+		r.vm.RAM[addr] = v
+		r.cpu.RAM[addr] = v
+	}
+	return nil
+}
+
+func parseAll(data []byte) ([]parser.Command, error) {
+	p := parser.NewParser(bufio.NewReader(strings.NewReader(string(data))))
+	cmds, errs := p.ParseAll()
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return cmds, nil
+}
+
+func (r *runner) isCheckpoint(fn string) bool {
+	for _, c := range r.opts.Checkpoints {
+		if c == fn {
+			return true
+		}
+	}
+	return false
+}
+
+// runVM runs the interpreter to the next checkpoint and returns its name
+func (r *runner) runVM() (string, error) {
+	for r.vm.Steps < r.opts.MaxSteps {
+		if r.vm.Halted() {
+			return "end", nil
+		}
+		if cmd, ok := r.vm.Next(); ok && !r.vmAtPoint &&
+			cmd.CmdType == parser.CmdFunction && r.isCheckpoint(cmd.Arg1) {
+			r.vmAtPoint = true
+			return cmd.Arg1, nil
+		}
+		r.vmAtPoint = false
+		if err := r.vm.Step(); err != nil {
+			return "", err
+		}
+	}
+	return "", interpreter.ErrStepLimit
+}
+
+// runCPU runs the emulator to the next checkpoint and returns its name
+func (r *runner) runCPU() (string, error) {
+	for r.cpu.Cycles < r.opts.MaxCycles {
+		// A function may start right with an endless loop, so checkpoints go first
+		if fn, ok := r.checkpoints[r.cpu.PC]; ok && !r.cpuAtPoint {
+			r.cpuAtPoint = true
+			return fn, nil
+		}
+		if r.cpu.Halted() {
+			return "end", nil
+		}
+		r.cpuAtPoint = false
+		if err := r.cpu.Step(); err != nil {
+			return "", err
+		}
+	}
+	return "", emulator.ErrCycleLimit
+}
+
+func (r *runner) compare() []string {
+	var diffs []string
+	report := func(name string, vmValue, cpuValue int16) {
+		if len(diffs) < maxReports {
+			diffs = append(diffs, fmt.Sprintf("%s: vm %d; asm %d", name, vmValue, cpuValue))
+		}
+	}
+	compareRAM := func(addr int) {
+		if r.vm.RAM[addr] != r.cpu.RAM[addr] {
+			report(fmt.Sprintf("RAM[%d]", addr), r.vm.RAM[addr], r.cpu.RAM[addr])
+		}
+	}
+
+	for addr := interpreter.SPAddr; addr <= interpreter.THATAddr; addr++ {
+		compareRAM(addr)
+	}
+	for addr := tempFirst; addr <= tempLast; addr++ {
+		compareRAM(addr)
+	}
+
+	retSlots := make(map[int]bool)
+	for _, s := range r.vm.ReturnAddrSlots() {
+		retSlots[s] = true
+	}
+	sp := int(r.vm.RAM[interpreter.SPAddr])
+	for addr := interpreter.StackBase; addr < sp && addr < heapFirst; addr++ {
+		if !retSlots[addr] {
+			compareRAM(addr)
+		}
+	}
+	for addr := heapFirst; addr <= heapLast; addr++ {
+		compareRAM(addr)
+	}
+
+	for _, name := range r.staticNames() {
+		var cpuValue int16
+		if addr, ok := r.prog.Vars[name]; ok {
+			cpuValue = r.cpu.RAM[addr]
+		}
+		if r.vm.Statics[name] != cpuValue {
+			report(name, r.vm.Statics[name], cpuValue)
+		}
+	}
+	return diffs
+}
+
+// staticNames returns the names of the static vars known to any of the machines
+func (r *runner) staticNames() []string {
+	set := make(map[string]bool)
+	for name := range r.vm.Statics {
+		set[name] = true
+	}
+	for name := range r.prog.Vars {
+		if r.isStaticName(name) {
+			set[name] = true
+		}
+	}
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *runner) isStaticName(name string) bool {
+	idx := strings.LastIndex(name, ".")
+	if idx < 0 {
+		return false
+	}
+	if _, err := strconv.Atoi(name[idx+1:]); err != nil {
+		return false
+	}
+	for _, f := range r.files {
+		if f == name[:idx] {
+			return true
+		}
+	}
+	return false
+}
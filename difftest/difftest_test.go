@@ -0,0 +1,223 @@
+package difftest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/verybigtuple/hackvmtranslator/codewriter"
+	"github.com/verybigtuple/hackvmtranslator/translator"
+)
+
+type program map[string]string
+
+func (p program) inputs() []translator.Input {
+	var inputs []translator.Input
+	for name, src := range p {
+		inputs = append(inputs, translator.Input{Path: name, Reader: strings.NewReader(src)})
+	}
+	return inputs
+}
+
+// segmentsProgram pushes and pops every segment with offsets that cover
+// all optimized code paths of the codewriter
+func segmentsProgram() program {
+	sb := strings.Builder{}
+	for _, segm := range []string{"local", "argument", "this", "that"} {
+		for i := 0; i <= 10; i++ {
+			fmt.Fprintf(&sb, "push constant %d\npop %s %d\n", 100+i, segm, i)
+		}
+		for i := 10; i >= 0; i-- {
+			fmt.Fprintf(&sb, "push %s %d\n", segm, i)
+		}
+		sb.WriteString("add\nsub\nneg\nnot\n")
+	}
+	for i := 0; i <= 7; i++ {
+		fmt.Fprintf(&sb, "push constant %d\npop temp %d\npush temp %d\n", i*3, i, i)
+	}
+	sb.WriteString("push constant 3030\npop pointer 0\npush constant 3040\npop pointer 1\n")
+	sb.WriteString("push pointer 0\npush pointer 1\nlt\npush pointer 1\npush pointer 0\ngt\n")
+	sb.WriteString("push constant 7\npush constant 7\neq\nand\nor\n")
+	sb.WriteString("push constant 5\npop static 0\npush static 0\npush static 0\neq\n")
+	sb.WriteString("push argument 3\npop that 9\npush argument 10\npop temp 2\npush static 0\npop argument 9\n")
+	sb.WriteString("label END\ngoto END\n")
+	return program{"Segments.vm": sb.String()}
+}
+
+var segmentsInit = map[int]int16{0: 256, 1: 300, 2: 400, 3: 3000, 4: 3010}
+
+func fibonacciProgram() program {
+	return program{
+		"Sys.vm": `
+		function Sys.init 0
+		push constant 12
+		call Main.run 1
+		pop static 0
+		call Counter.inc 0
+		call Counter.inc 0
+		pop temp 0
+		label END
+		goto END
+		`,
+		"Main.vm": `
+		function Main.run 0
+		push argument 0
+		call Main.fibonacci 1
+		return
+		function Main.fibonacci 0
+		push argument 0
+		push constant 2
+		lt
+		if-goto BASE
+		push argument 0
+		push constant 2
+		call Main.minus 2
+		call Main.fibonacci 1
+		push argument 0
+		push constant 1
+		call Main.minus 2
+		call Main.fibonacci 1
+		add
+		return
+		label BASE
+		push argument 0
+		return
+		function Main.minus 1
+		push argument 0
+		push argument 1
+		sub
+		pop local 0
+		push static 1
+		push constant 1
+		add
+		pop static 1
+		push local 0
+		return
+		`,
+		"Counter.vm": `
+		function Counter.inc 2
+		push static 0
+		push constant 1
+		add
+		pop static 0
+		push constant 2048
+		pop pointer 1
+		push static 0
+		pop that 5
+		push static 0
+		return
+		`,
+	}
+}
+
+func TestRunPrograms(t *testing.T) {
+	compact := codewriter.Options{CompactCalls: true, SharedCompare: true}
+	peephole := codewriter.Options{Peephole: codewriter.PeepholeAll}
+	testCases := []struct {
+		desc string
+		prog program
+		opts Options
+	}{
+		{"Segments", segmentsProgram(), Options{
+			Translator: translator.Options{NoBootstrap: true},
+			Init:       segmentsInit,
+		}},
+		{"Fibonacci", fibonacciProgram(), Options{}},
+		{"Fibonacci checkpoints", fibonacciProgram(), Options{
+			Checkpoints: []string{"Sys.init", "Main.fibonacci", "Counter.inc"},
+		}},
+		{"Segments compact", segmentsProgram(), Options{
+			Translator: translator.Options{NoBootstrap: true, CodeWriter: compact},
+			Init:       segmentsInit,
+		}},
+		{"Fibonacci compact checkpoints", fibonacciProgram(), Options{
+			Translator:  translator.Options{CodeWriter: compact},
+			Checkpoints: []string{"Sys.init", "Main.fibonacci", "Counter.inc"},
+		}},
+		{"Segments peephole", segmentsProgram(), Options{
+			Translator: translator.Options{NoBootstrap: true, CodeWriter: peephole},
+			Init:       segmentsInit,
+		}},
+		{"Fibonacci peephole checkpoints", fibonacciProgram(), Options{
+			Translator:  translator.Options{CodeWriter: peephole},
+			Checkpoints: []string{"Sys.init", "Main.fibonacci", "Counter.inc"},
+		}},
+		{"Segments fused", segmentsProgram(), Options{
+			Translator: translator.Options{NoBootstrap: true, FusePushPop: true},
+			Init:       segmentsInit,
+		}},
+		{"Segments cached", segmentsProgram(), Options{
+			Translator: translator.Options{NoBootstrap: true, CodeWriter: codewriter.Options{CacheTOS: true}},
+			Init:       segmentsInit,
+		}},
+		{"Fibonacci cached checkpoints", fibonacciProgram(), Options{
+			Translator:  translator.Options{CodeWriter: codewriter.Options{CacheTOS: true}},
+			Checkpoints: []string{"Sys.init", "Main.fibonacci", "Counter.inc"},
+		}},
+		// Main.run calls Main.fibonacci in its frame, so the stacks differ in Main.fibonacci
+		{"Fibonacci tail calls checkpoints", fibonacciProgram(), Options{
+			Translator:  translator.Options{TailCalls: true},
+			Checkpoints: []string{"Sys.init", "Counter.inc"},
+		}},
+		// Main.fibonacci gets the args and the local of the inlined Main.minus as extra locals,
+		// so the stacks differ in Main.fibonacci
+		{"Fibonacci inlined checkpoints", fibonacciProgram(), Options{
+			Translator:  translator.Options{InlineMax: 10},
+			Checkpoints: []string{"Sys.init", "Counter.inc"},
+		}},
+		{"Segments folded", segmentsProgram(), Options{
+			Translator: translator.Options{NoBootstrap: true, FoldConstants: true, FusePushPop: true, CodeWriter: peephole},
+			Init:       segmentsInit,
+		}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			rep, err := Run(context.Background(), tc.prog.inputs(), tc.opts)
+			if err != nil {
+				t.Errorf("Unexpected error %v", err)
+				return
+			}
+			if len(tc.opts.Checkpoints) > 0 && rep.Checkpoints < 3 {
+				t.Errorf("Too few checkpoints %d", rep.Checkpoints)
+			}
+		})
+	}
+}
+
+func TestCompareMismatch(t *testing.T) {
+	prog := segmentsProgram()
+	sources, err := readSources(prog.inputs())
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	r := &runner{
+		opts:        Options{Translator: translator.Options{NoBootstrap: true}, MaxSteps: 1000, MaxCycles: 1000},
+		checkpoints: make(map[uint16]string),
+	}
+	if err := r.load(context.Background(), sources); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if diffs := r.compare(); len(diffs) != 0 {
+		t.Errorf("Unexpected diffs %v", diffs)
+	}
+	r.cpu.RAM[3000] = 1
+	r.vm.Statics["Segments.0"] = 2
+	if diffs := r.compare(); len(diffs) != 2 {
+		t.Errorf("Want 2 diffs, got %v", diffs)
+	}
+}
+
+func TestRunLimit(t *testing.T) {
+	prog := program{"Loop.vm": "label L\npush constant 1\npop temp 0\ngoto L\n"}
+	opts := Options{Translator: translator.Options{NoBootstrap: true}, MaxSteps: 100}
+	_, err := Run(context.Background(), prog.inputs(), opts)
+	if err == nil {
+		t.Errorf("Error is not arisen")
+	}
+	var m *Mismatch
+	if errors.As(err, &m) {
+		t.Errorf("Unexpected mismatch %v", m)
+	}
+}
@@ -0,0 +1,156 @@
+// Package emulator runs Hack machine code the way the nand2tetris CPUEmulator does
+package emulator
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/verybigtuple/hackvmtranslator/assembler"
+)
+
+// RAMSize is the number of RAM registers including the screen and the keyboard
+const RAMSize = 1 << 15
+
+// ErrCycleLimit is returned by Run if the program has not halted in time
+var ErrCycleLimit = errors.New("Cycle limit is exceeded")
+
+// CPU is a Hack computer: CPU registers, RAM and ROM
+type CPU struct {
+	RAM [RAMSize]int16
+	ROM []uint16
+
+	A  int16
+	D  int16
+	PC uint16
+
+	Cycles int // Number of executed instructions
+}
+
+// New returns a CPU with the program loaded into ROM
+func New(rom []uint16) *CPU {
+	return &CPU{ROM: rom}
+}
+
+// NewFromAsm assembles the asm program and loads it into a new CPU
+func NewFromAsm(r io.Reader) (*CPU, *assembler.Program, error) {
+	prog, err := assembler.Assemble(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return New(prog.Code), prog, nil
+}
+
+// Reset sets PC to zero. RAM is not changed
+func (c *CPU) Reset() {
+	c.PC = 0
+}
+
+// Halted reports whether PC is beyond the program or the CPU is in an endless loop
+// like (END) @END 0;JMP
+func (c *CPU) Halted() bool {
+	if int(c.PC) >= len(c.ROM) {
+		return true
+	}
+	instr := c.ROM[c.PC]
+	if instr&0x8000 != 0 || instr != c.PC || int(c.PC)+1 >= len(c.ROM) {
+		return false
+	}
+	next := c.ROM[c.PC+1]
+	return next&0x8000 != 0 && next&0b111 == 0b111
+}
+
+// Run executes instructions until the program halts. It returns ErrCycleLimit
+// if the program is still running after maxCycles instructions
+func (c *CPU) Run(maxCycles int) error {
+	for i := 0; i < maxCycles; i++ {
+		if c.Halted() {
+			return nil
+		}
+		if err := c.Step(); err != nil {
+			return err
+		}
+	}
+	if c.Halted() {
+		return nil
+	}
+	return ErrCycleLimit
+}
+
+// Step executes one instruction
+func (c *CPU) Step() error {
+	if int(c.PC) >= len(c.ROM) {
+		return fmt.Errorf("PC %d is out of ROM", c.PC)
+	}
+	instr := c.ROM[c.PC]
+	c.Cycles++
+
+	// A-instruction
+	if instr&0x8000 == 0 {
+		c.A = int16(instr)
+		c.PC++
+		return nil
+	}
+
+	// C-instruction: 111a cccc ccdd djjj
+	addr := c.A
+	y := c.A
+	if instr&0x1000 != 0 {
+		if addr < 0 {
+			return fmt.Errorf("PC %d: Illegal RAM address %d", c.PC, addr)
+		}
+		y = c.RAM[addr]
+	}
+	out := alu(c.D, y, instr>>6&0x3F)
+
+	if instr&0b001000 != 0 {
+		if addr < 0 {
+			return fmt.Errorf("PC %d: Illegal RAM address %d", c.PC, addr)
+		}
+		c.RAM[addr] = out
+	}
+	if instr&0b100000 != 0 {
+		c.A = out
+	}
+	if instr&0b010000 != 0 {
+		c.D = out
+	}
+
+	if jump(out, instr&0b111) {
+		c.PC = uint16(addr)
+	} else {
+		c.PC++
+	}
+	return nil
+}
+
+func alu(x, y int16, ctrl uint16) int16 {
+	if ctrl&0b100000 != 0 { // zx
+		x = 0
+	}
+	if ctrl&0b010000 != 0 { // nx
+		x = ^x
+	}
+	if ctrl&0b001000 != 0 { // zy
+		y = 0
+	}
+	if ctrl&0b000100 != 0 { // ny
+		y = ^y
+	}
+	var out int16
+	if ctrl&0b000010 != 0 { // f
+		out = x + y
+	} else {
+		out = x & y
+	}
+	if ctrl&0b000001 != 0 { // no
+		out = ^out
+	}
+	return out
+}
+
+func jump(out int16, j uint16) bool {
+	return (j&0b100 != 0 && out < 0) ||
+		(j&0b010 != 0 && out == 0) ||
+		(j&0b001 != 0 && out > 0)
+}
@@ -0,0 +1,116 @@
+package emulator
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func newCPUString(t *testing.T, s string) *CPU {
+	t.Helper()
+	cpu, _, err := NewFromAsm(strings.NewReader(s))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	return cpu
+}
+
+func TestRunMax(t *testing.T) {
+	src := `
+	// R2 = max(R0, R1)
+	@R0
+	D=M
+	@R1
+	D=D-M
+	@FIRST
+	D;JGT
+	@R1
+	D=M
+	@WRITE
+	0;JMP
+	(FIRST)
+	@R0
+	D=M
+	(WRITE)
+	@R2
+	M=D
+	(END)
+	@END
+	0;JMP
+	`
+	testCases := []struct {
+		r0, r1, want int16
+	}{
+		{3, 5, 5},
+		{7, -2, 7},
+		{-4, -9, -4},
+	}
+	for _, tc := range testCases {
+		cpu := newCPUString(t, src)
+		cpu.RAM[0], cpu.RAM[1] = tc.r0, tc.r1
+		if err := cpu.Run(1000); err != nil {
+			t.Errorf("Unexpected error %v", err)
+			continue
+		}
+		if cpu.RAM[2] != tc.want {
+			t.Errorf("max(%d, %d): actual %d; want %d", tc.r0, tc.r1, cpu.RAM[2], tc.want)
+		}
+	}
+}
+
+func TestRunRegisters(t *testing.T) {
+	src := `
+	@100
+	D=A
+	@SP
+	M=D
+	AM=M-1
+	M=-1
+	D=D+1
+	`
+	cpu := newCPUString(t, src)
+	if err := cpu.Run(100); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if cpu.RAM[0] != 99 || cpu.A != 99 || cpu.RAM[99] != -1 || cpu.D != 101 {
+		t.Errorf("Wrong state: SP=%d A=%d RAM[99]=%d D=%d", cpu.RAM[0], cpu.A, cpu.RAM[99], cpu.D)
+	}
+	if cpu.Cycles != 7 || int(cpu.PC) != len(cpu.ROM) {
+		t.Errorf("Wrong cycles %d or PC %d", cpu.Cycles, cpu.PC)
+	}
+}
+
+func TestRunOverflow(t *testing.T) {
+	src := `
+	@32767
+	D=A
+	D=D+1
+	@R0
+	M=D
+	`
+	cpu := newCPUString(t, src)
+	if err := cpu.Run(100); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if cpu.RAM[0] != -32768 {
+		t.Errorf("Actual %d; want -32768", cpu.RAM[0])
+	}
+}
+
+func TestRunCycleLimit(t *testing.T) {
+	src := `
+	(LOOP)
+	@R0
+	M=M+1
+	@LOOP
+	0;JMP
+	`
+	cpu := newCPUString(t, src)
+	err := cpu.Run(10)
+	if !errors.Is(err, ErrCycleLimit) {
+		t.Errorf("Want ErrCycleLimit, got %v", err)
+	}
+	if cpu.Cycles != 10 {
+		t.Errorf("Actual cycles %d; want 10", cpu.Cycles)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/verybigtuple/hackvmtranslator/analysis"
+	"github.com/verybigtuple/hackvmtranslator/translator"
+)
+
+// runGraph writes the call graph of the program in DOT or JSON
+func runGraph(args []string) int {
+	fs := flag.NewFlagSet("graph", flag.ExitOnError)
+	format := fs.String("format", "dot", "Output format: 'dot' for Graphviz or 'json'")
+	outPath := fs.String("out", "", "Output file. The graph is written to stdout by default")
+	fs.Parse(args)
+
+	if fs.Arg(0) == "" {
+		fmt.Fprintln(os.Stderr, "Argument Error: Input file/folder is not set")
+		return 1
+	}
+	if *format != "dot" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "Argument Error: Unknown graph format %s\n", *format)
+		return 1
+	}
+
+	paths, err := translator.InputFiles(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot get input file or directory: %v\n", err)
+		return 2
+	}
+	inputs := make([]translator.Input, len(paths))
+	for i, p := range paths {
+		inputs[i] = translator.Input{Path: p}
+	}
+	files, diags := translator.Parse(context.Background(), inputs, translator.Options{})
+	if len(diags) > 0 {
+		fmt.Fprintln(os.Stderr, "Errors during parsing:")
+		printDiagnostics(diags)
+		return 3
+	}
+
+	var w io.Writer = os.Stdout
+	var outFile *os.File
+	if *outPath != "" {
+		outFile, err = os.Create(*outPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot create output file: %v\n", err)
+			return 3
+		}
+		w = outFile
+	}
+
+	g := analysis.BuildCallGraph(files)
+	if *format == "json" {
+		err = g.WriteJSON(w)
+	} else {
+		err = g.WriteDOT(w)
+	}
+	// Write errors of the file may be reported only on close
+	if outFile != nil {
+		if cerr := outFile.Close(); cerr != nil && err == nil {
+			err = fmt.Errorf("Cannot close output file: %w", cerr)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 3
+	}
+	return 0
+}
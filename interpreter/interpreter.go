@@ -0,0 +1,424 @@
+// Package interpreter executes parsed VM commands directly with the standard
+// Hack memory model. It is a reference for the translated asm code
+package interpreter
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/verybigtuple/hackvmtranslator/analysis"
+	"github.com/verybigtuple/hackvmtranslator/parser"
+)
+
+// RAMSize is the number of RAM registers
+const RAMSize = 1 << 15
+
+// Addresses of the memory model
+const (
+	SPAddr       = 0
+	LCLAddr      = 1
+	ARGAddr      = 2
+	THISAddr     = 3
+	THATAddr     = 4
+	TempBaseAddr = 5
+	StackBase    = 256
+)
+
+// ErrStepLimit is returned by Run if the program has not halted in time
+var ErrStepLimit = errors.New("Step limit is exceeded")
+
+var segmentAddrs = map[string]int{
+	parser.LocalKey:    LCLAddr,
+	parser.ArgumentKey: ARGAddr,
+	parser.ThisKey:     THISAddr,
+	parser.ThatKey:     THATAddr,
+}
+
+// File is a parsed VM file. For the interpreter Name is the static prefix, e.g. Main for Main.vm
+type File = analysis.File
+
+type instr struct {
+	cmd    parser.Command
+	file   string
+	fn     string
+	target int // Resolved jump target for goto, if-goto and call
+}
+
+// Machine is a VM interpreter
+type Machine struct {
+	RAM     [RAMSize]int16
+	Statics map[string]int16 // Static vars by their asm names, e.g. Main.3
+	Steps   int              // Number of executed commands
+
+	prog   []instr
+	pc     int
+	frames []int // Addresses of return addresses of active calls
+}
+
+// New loads files in the given order. All labels and functions must be resolved
+func New(files []File) (*Machine, error) {
+	m := &Machine{Statics: make(map[string]int16)}
+
+	labels := make(map[string]int)
+	funcs := make(map[string]int)
+	for _, f := range files {
+		fn := ""
+		for _, cmd := range f.Commands {
+			switch cmd.CmdType {
+			case parser.CmdFunction:
+				fn = cmd.Arg1
+				if _, ok := funcs[fn]; ok {
+					return nil, fmt.Errorf("File %s: Duplicate function %s", f.Name, fn)
+				}
+				funcs[fn] = len(m.prog)
+			case parser.CmdLabel:
+				key := fn + "$" + cmd.Arg1
+				if _, ok := labels[key]; ok {
+					return nil, fmt.Errorf("File %s: Duplicate label %s", f.Name, key)
+				}
+				labels[key] = len(m.prog)
+			}
+			m.prog = append(m.prog, instr{cmd: cmd, file: f.Name, fn: fn})
+		}
+	}
+
+	for i := range m.prog {
+		in := &m.prog[i]
+		var ok bool
+		switch in.cmd.CmdType {
+		case parser.CmdGoto, parser.CmdIfGoto:
+			in.target, ok = labels[in.fn+"$"+in.cmd.Arg1]
+			if !ok {
+				return nil, fmt.Errorf("File %s: Undefined label %s in %s", in.file, in.cmd.Arg1, in.fn)
+			}
+		case parser.CmdCall:
+			in.target, ok = funcs[in.cmd.Arg1]
+			if !ok {
+				return nil, fmt.Errorf("File %s: Undefined function %s", in.file, in.cmd.Arg1)
+			}
+		}
+	}
+	return m, nil
+}
+
+// Bootstrap sets SP to 256 and calls Sys.init. Returning from Sys.init halts the machine
+func (m *Machine) Bootstrap() error {
+	m.RAM[SPAddr] = StackBase
+	for i, in := range m.prog {
+		if in.cmd.CmdType == parser.CmdFunction && in.cmd.Arg1 == analysis.SysInit {
+			m.call(i, 0, len(m.prog))
+			return nil
+		}
+	}
+	return fmt.Errorf("Function %s is not found", analysis.SysInit)
+}
+
+// Halted reports whether the program ended or is in an endless loop like
+// label END; goto END
+func (m *Machine) Halted() bool {
+	if m.pc < 0 || m.pc >= len(m.prog) {
+		return true
+	}
+	in := m.prog[m.pc]
+	switch in.cmd.CmdType {
+	case parser.CmdGoto:
+		return in.target == m.pc-1
+	case parser.CmdLabel:
+		return m.pc+1 < len(m.prog) && m.prog[m.pc+1].target == m.pc &&
+			m.prog[m.pc+1].cmd.CmdType == parser.CmdGoto
+	}
+	return false
+}
+
+// Run executes commands until the program halts. It returns ErrStepLimit
+// if the program is still running after maxSteps commands
+func (m *Machine) Run(maxSteps int) error {
+	for i := 0; i < maxSteps; i++ {
+		if m.Halted() {
+			return nil
+		}
+		if err := m.Step(); err != nil {
+			return err
+		}
+	}
+	if m.Halted() {
+		return nil
+	}
+	return ErrStepLimit
+}
+
+// Function returns the name of the function which is being executed
+func (m *Machine) Function() string {
+	if m.pc < 0 || m.pc >= len(m.prog) {
+		return ""
+	}
+	return m.prog[m.pc].fn
+}
+
+// Next returns the command that will be executed by the next Step
+func (m *Machine) Next() (parser.Command, bool) {
+	if m.pc < 0 || m.pc >= len(m.prog) {
+		return parser.Command{}, false
+	}
+	return m.prog[m.pc].cmd, true
+}
+
+// ReturnAddrSlots returns RAM addresses that keep return addresses of active calls.
+// Their values are indexes of VM commands, not ROM addresses
+func (m *Machine) ReturnAddrSlots() []int {
+	return append([]int(nil), m.frames...)
+}
+
+// Step executes one command
+func (m *Machine) Step() (err error) {
+	if m.pc < 0 || m.pc >= len(m.prog) {
+		return fmt.Errorf("Command index %d is out of the program", m.pc)
+	}
+	in := m.prog[m.pc]
+	cmd := in.cmd
+	m.Steps++
+	m.pc++
+
+	defer func() {
+		if err != nil {
+			err = fmt.Errorf("File %s, Line %d, %s: %w", in.file, cmd.Pos.Line, cmdString(cmd), err)
+		}
+	}()
+
+	switch cmd.CmdType {
+	case parser.CmdPush:
+		var v int16
+		v, err = m.load(in)
+		if err == nil {
+			err = m.push(v)
+		}
+	case parser.CmdPop:
+		var v int16
+		v, err = m.pop()
+		if err == nil {
+			err = m.store(in, v)
+		}
+	case parser.CmdArithmeticBinary, parser.CmdArithmeticCond:
+		err = m.binary(cmd.Arg1)
+	case parser.CmdArithmeticUnary:
+		err = m.unary(cmd.Arg1)
+	case parser.CmdLabel:
+	case parser.CmdGoto:
+		m.pc = in.target
+	case parser.CmdIfGoto:
+		var v int16
+		v, err = m.pop()
+		if err == nil && v != 0 {
+			m.pc = in.target
+		}
+	case parser.CmdFunction:
+		for i := 0; i < cmd.Arg2 && err == nil; i++ {
+			err = m.push(0)
+		}
+	case parser.CmdCall:
+		err = m.call(in.target, cmd.Arg2, m.pc)
+	case parser.CmdReturn:
+		err = m.ret()
+	default:
+		err = fmt.Errorf("Unknown command type %d", cmd.CmdType)
+	}
+	return
+}
+
+func (m *Machine) call(target, nArgs, retAddr int) error {
+	frame := int(m.RAM[SPAddr])
+	if err := m.push(int16(retAddr)); err != nil {
+		return err
+	}
+	for _, addr := range [...]int{LCLAddr, ARGAddr, THISAddr, THATAddr} {
+		if err := m.push(m.RAM[addr]); err != nil {
+			return err
+		}
+	}
+	m.RAM[ARGAddr] = m.RAM[SPAddr] - 5 - int16(nArgs)
+	m.RAM[LCLAddr] = m.RAM[SPAddr]
+	m.frames = append(m.frames, frame)
+	m.pc = target
+	return nil
+}
+
+func (m *Machine) ret() error {
+	endFrame := int(m.RAM[LCLAddr])
+	retAddr, err := m.read(endFrame - 5)
+	if err != nil {
+		return err
+	}
+	v, err := m.pop()
+	if err != nil {
+		return err
+	}
+	if err := m.write(int(m.RAM[ARGAddr]), v); err != nil {
+		return err
+	}
+	m.RAM[SPAddr] = m.RAM[ARGAddr] + 1
+	for i, addr := range [...]int{THATAddr, THISAddr, ARGAddr, LCLAddr} {
+		saved, err := m.read(endFrame - 1 - i)
+		if err != nil {
+			return err
+		}
+		m.RAM[addr] = saved
+	}
+	if n := len(m.frames); n > 0 {
+		m.frames = m.frames[:n-1]
+	}
+	m.pc = int(retAddr)
+	return nil
+}
+
+func (m *Machine) binary(op string) error {
+	y, err := m.pop()
+	if err != nil {
+		return err
+	}
+	x, err := m.pop()
+	if err != nil {
+		return err
+	}
+	var r int16
+	switch op {
+	case parser.AddKey:
+		r = x + y
+	case parser.SubKey:
+		r = x - y
+	case parser.AndKey:
+		r = x & y
+	case parser.OrKey:
+		r = x | y
+	case parser.EqKey:
+		r = boolValue(x == y)
+	case parser.GtKey:
+		r = boolValue(x > y)
+	case parser.LtKey:
+		r = boolValue(x < y)
+	default:
+		return fmt.Errorf("Unknown operation %s", op)
+	}
+	return m.push(r)
+}
+
+func (m *Machine) unary(op string) error {
+	x, err := m.pop()
+	if err != nil {
+		return err
+	}
+	switch op {
+	case parser.NegKey:
+		x = -x
+	case parser.NotKey:
+		x = ^x
+	default:
+		return fmt.Errorf("Unknown operation %s", op)
+	}
+	return m.push(x)
+}
+
+func (m *Machine) segmentAddr(in instr) (int, error) {
+	cmd := in.cmd
+	switch {
+	case parser.IsTempSegment(cmd.Arg1):
+		return TempBaseAddr + cmd.Arg2, nil
+	case parser.IsPointerSegment(cmd.Arg1):
+		return THISAddr + cmd.Arg2, nil
+	}
+	base, ok := segmentAddrs[cmd.Arg1]
+	if !ok {
+		return 0, fmt.Errorf("Unknown segment %s", cmd.Arg1)
+	}
+	return int(m.RAM[base]) + cmd.Arg2, nil
+}
+
+func (m *Machine) load(in instr) (int16, error) {
+	switch {
+	case parser.IsConstantSegment(in.cmd.Arg1):
+		return int16(in.cmd.Arg2), nil
+	case parser.IsStaticSegment(in.cmd.Arg1):
+		return m.Statics[staticName(in)], nil
+	}
+	addr, err := m.segmentAddr(in)
+	if err != nil {
+		return 0, err
+	}
+	return m.read(addr)
+}
+
+func (m *Machine) store(in instr, v int16) error {
+	switch {
+	case parser.IsConstantSegment(in.cmd.Arg1):
+		return fmt.Errorf("Cannot pop to constant")
+	case parser.IsStaticSegment(in.cmd.Arg1):
+		m.Statics[staticName(in)] = v
+		return nil
+	}
+	addr, err := m.segmentAddr(in)
+	if err != nil {
+		return err
+	}
+	return m.write(addr, v)
+}
+
+func (m *Machine) push(v int16) error {
+	if err := m.write(int(m.RAM[SPAddr]), v); err != nil {
+		return err
+	}
+	m.RAM[SPAddr]++
+	return nil
+}
+
+func (m *Machine) pop() (int16, error) {
+	m.RAM[SPAddr]--
+	return m.read(int(m.RAM[SPAddr]))
+}
+
+func (m *Machine) read(addr int) (int16, error) {
+	if addr < 0 || addr >= RAMSize {
+		return 0, fmt.Errorf("Illegal RAM address %d", addr)
+	}
+	return m.RAM[addr], nil
+}
+
+func (m *Machine) write(addr int, v int16) error {
+	if addr < 0 || addr >= RAMSize {
+		return fmt.Errorf("Illegal RAM address %d", addr)
+	}
+	m.RAM[addr] = v
+	return nil
+}
+
+func staticName(in instr) string {
+	return in.file + "." + strconv.Itoa(in.cmd.Arg2)
+}
+
+func boolValue(b bool) int16 {
+	if b {
+		return -1
+	}
+	return 0
+}
+
+func cmdString(cmd parser.Command) string {
+	switch cmd.CmdType {
+	case parser.CmdPush:
+		return fmt.Sprintf("push %s %d", cmd.Arg1, cmd.Arg2)
+	case parser.CmdPop:
+		return fmt.Sprintf("pop %s %d", cmd.Arg1, cmd.Arg2)
+	case parser.CmdLabel:
+		return "label " + cmd.Arg1
+	case parser.CmdGoto:
+		return "goto " + cmd.Arg1
+	case parser.CmdIfGoto:
+		return "if-goto " + cmd.Arg1
+	case parser.CmdFunction:
+		return fmt.Sprintf("function %s %d", cmd.Arg1, cmd.Arg2)
+	case parser.CmdCall:
+		return fmt.Sprintf("call %s %d", cmd.Arg1, cmd.Arg2)
+	case parser.CmdReturn:
+		return "return"
+	}
+	return cmd.Arg1
+}
@@ -0,0 +1,183 @@
+package interpreter
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/verybigtuple/hackvmtranslator/parser"
+)
+
+func parseFile(t *testing.T, name, src string) File {
+	t.Helper()
+	p := parser.NewParser(bufio.NewReader(strings.NewReader(src)))
+	f := File{Name: name}
+	for {
+		cmd, err := p.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Parser error %v", err)
+		}
+		f.Commands = append(f.Commands, *cmd)
+	}
+	return f
+}
+
+func TestRunStack(t *testing.T) {
+	src := `
+	push constant 7
+	push constant 8
+	add
+	push constant 32767
+	push constant 1
+	add
+	push constant 5
+	push constant 6
+	lt
+	not
+	`
+	m, err := New([]File{parseFile(t, "Test", src)})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	m.RAM[SPAddr] = StackBase
+	if err := m.Run(100); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	want := []int16{15, -32768, 0}
+	if int(m.RAM[SPAddr]) != StackBase+len(want) {
+		t.Fatalf("SP: actual %d; want %d", m.RAM[SPAddr], StackBase+len(want))
+	}
+	for i, w := range want {
+		if m.RAM[StackBase+i] != w {
+			t.Errorf("RAM[%d]: actual %d; want %d", StackBase+i, m.RAM[StackBase+i], w)
+		}
+	}
+}
+
+func TestRunSegments(t *testing.T) {
+	src := `
+	push constant 10
+	pop local 2
+	push constant 21
+	pop argument 1
+	push constant 3030
+	pop pointer 0
+	push constant 36
+	pop this 6
+	push constant 8
+	pop temp 3
+	push constant 9
+	pop static 4
+	`
+	m, err := New([]File{parseFile(t, "Test", src)})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	m.RAM[SPAddr], m.RAM[LCLAddr], m.RAM[ARGAddr] = 256, 300, 400
+	if err := m.Run(100); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	checks := map[int]int16{302: 10, 401: 21, THISAddr: 3030, 3036: 36, 8: 8, SPAddr: 256}
+	for addr, w := range checks {
+		if m.RAM[addr] != w {
+			t.Errorf("RAM[%d]: actual %d; want %d", addr, m.RAM[addr], w)
+		}
+	}
+	if m.Statics["Test.4"] != 9 {
+		t.Errorf("Static: actual %d; want 9", m.Statics["Test.4"])
+	}
+}
+
+func TestRunFibonacci(t *testing.T) {
+	sys := `
+	function Sys.init 0
+	push constant 10
+	call Main.fibonacci 1
+	pop static 0
+	label END
+	goto END
+	`
+	main := `
+	function Main.fibonacci 0
+	push argument 0
+	push constant 2
+	lt
+	if-goto BASE
+	push argument 0
+	push constant 2
+	sub
+	call Main.fibonacci 1
+	push argument 0
+	push constant 1
+	sub
+	call Main.fibonacci 1
+	add
+	return
+	label BASE
+	push argument 0
+	return
+	`
+	m, err := New([]File{parseFile(t, "Main", main), parseFile(t, "Sys", sys)})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := m.Bootstrap(); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if err := m.Run(100000); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if m.Statics["Sys.0"] != 55 {
+		t.Errorf("fibonacci(10): actual %d; want 55", m.Statics["Sys.0"])
+	}
+	if m.RAM[SPAddr] != 261 || m.RAM[LCLAddr] != 261 || m.RAM[ARGAddr] != 256 {
+		t.Errorf("Wrong Sys.init frame: %v", m.RAM[0:3])
+	}
+	if slots := m.ReturnAddrSlots(); len(slots) != 1 || slots[0] != 256 {
+		t.Errorf("Wrong return address slots %v", slots)
+	}
+	if m.Function() != "Sys.init" {
+		t.Errorf("Halted in %s", m.Function())
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	testCases := []struct {
+		desc string
+		src  string
+	}{
+		{"Undefined label", "function Main.f 0\ngoto L"},
+		{"Label of other function", "function Main.f 0\nlabel L\nfunction Main.g 0\ngoto L"},
+		{"Undefined function", "call Main.g 0"},
+		{"Duplicate function", "function Main.f 0\nfunction Main.f 0"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if _, err := New([]File{parseFile(t, "Main", tc.src)}); err == nil {
+				t.Errorf("Error is not arisen")
+			}
+		})
+	}
+}
+
+func TestRunStepLimit(t *testing.T) {
+	src := `
+	label LOOP
+	push constant 1
+	pop temp 0
+	goto LOOP
+	`
+	m, err := New([]File{parseFile(t, "Test", src)})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	m.RAM[SPAddr] = StackBase
+	if err := m.Run(50); !errors.Is(err, ErrStepLimit) {
+		t.Errorf("Want ErrStepLimit, got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package parser
+
+import (
+	"fmt"
+)
+
+// Severity of a diagnostic
+type Severity int
+
+// Severities of diagnostics
+const (
+	SeverityError Severity = iota
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	if s == SeverityWarning {
+		return "warning"
+	}
+	return "error"
+}
+
+// MarshalText makes severities readable in JSON
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Code is a stable identifier of a diagnostic. Codes are never reused,
+// so tools can match them instead of the messages
+type Code string
+
+// Codes of the parser diagnostics
+const (
+	CodeInternal       Code = "VM000" // Error which is not a diagnostic of the VM code, e.g. IO error
+	CodeUnknownCommand Code = "VM001"
+	CodeBadSegment     Code = "VM002"
+	CodeArgCount       Code = "VM003"
+	CodeNotInteger     Code = "VM004"
+	CodeNegative       Code = "VM005"
+	CodeOutOfRange     Code = "VM006"
+)
+
+// Diagnostic is a positioned error or warning about the VM code
+type Diagnostic struct {
+	Severity Severity `json:"severity"`
+	Code     Code     `json:"code"`
+	Pos      Pos      `json:"pos"`
+	Msg      string   `json:"message"`
+}
+
+func (d *Diagnostic) Error() string {
+	if d.Pos.Line == 0 {
+		return fmt.Sprintf("%s [%s]", d.Msg, d.Code)
+	}
+	return fmt.Sprintf("Line %d:%d: %s [%s]", d.Pos.Line, d.Pos.Col, d.Msg, d.Code)
+}
+
+// diag creates an error diagnostic which points to the words of the line from first to last
+func (l srcLine) diag(code Code, first, last int, format string, a ...interface{}) *Diagnostic {
+	start := l.words[first].col
+	end := l.words[last].col + len(l.words[last].text)
+	return &Diagnostic{
+		Severity: SeverityError,
+		Code:     code,
+		Pos:      Pos{Col: start, EndCol: end, Text: l.text[start-1 : end-1]},
+		Msg:      fmt.Sprintf(format, a...),
+	}
+}
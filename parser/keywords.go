@@ -1,7 +1,5 @@
 package parser
 
-import "strings"
-
 // VM language KeyWords
 const (
 	PushKey   = "push"
@@ -23,6 +21,9 @@ const (
 	ReturnKey = "return"
 )
 
+// SysInit is the entry function called by the bootstrapping code
+const SysInit = "Sys.init"
+
 // Segments
 const (
 	LocalKey    = "local"
@@ -35,6 +36,15 @@ const (
 	TempKey     = "temp"
 )
 
+// Limits of segment offsets
+const (
+	TempSize    = 8
+	PointerSize = 2
+	MaxConstant = 32767
+	// DefaultStaticLimit is a limit of static vars of all files as they are placed in RAM[16..255]
+	DefaultStaticLimit = 240
+)
+
 // CommentPrefix is lieteral with that comment starts
 const CommentPrefix = "//"
 
@@ -76,7 +86,3 @@ func isValidPopSegment(s string) bool {
 func isValidPushSegment(s string) bool {
 	return isValidSegment(s)
 }
-
-func isComment(s string) bool {
-	return strings.HasPrefix(s, CommentPrefix)
-}
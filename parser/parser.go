@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 )
@@ -46,7 +47,7 @@ var cmdTypes = map[string]CommandType{
 	ReturnKey: CmdReturn,
 }
 
-var cmdConverters = map[CommandType]func(CommandType, []string) (*Command, error){
+var cmdConverters = map[CommandType]func(CommandType, srcLine) (*Command, *Diagnostic){
 	CmdPush:             convertPushPop,
 	CmdPop:              convertPushPop,
 	CmdArithmeticBinary: convertArithmetic,
@@ -60,138 +61,272 @@ var cmdConverters = map[CommandType]func(CommandType, []string) (*Command, error
 	CmdReturn:           convertReturn,
 }
 
-func checkNullArgs(words []string) (err error) {
-	if len(words) > 1 && !isComment(words[1]) {
-		err = errors.New("Too many arguments")
+func checkNullArgs(l srcLine) *Diagnostic {
+	if len(l.words) > 1 {
+		return l.diag(CodeArgCount, 1, len(l.words)-1, "Too many arguments")
 	}
-	return
+	return nil
 }
 
-func checkOneArg(words []string) (string, error) {
-	if len(words) < 2 || (len(words) > 2 && !isComment(words[2])) {
-		return "", errors.New("One argument expected")
+func checkOneArg(l srcLine) (string, *Diagnostic) {
+	if len(l.words) < 2 {
+		return "", l.diag(CodeArgCount, 0, 0, "One argument expected")
 	}
-	return words[1], nil
+	if len(l.words) > 2 {
+		return "", l.diag(CodeArgCount, 2, len(l.words)-1, "One argument expected")
+	}
+	return l.words[1].text, nil
 }
 
-func checkTwoArgs(words []string) (string, int, error) {
-	if len(words) < 3 || (len(words) > 3 && !isComment(words[3])) {
-		return "", 0, errors.New("Three argument expected")
+func checkTwoArgs(l srcLine) (string, int, *Diagnostic) {
+	if len(l.words) < 3 {
+		return "", 0, l.diag(CodeArgCount, 0, len(l.words)-1, "Two arguments expected")
+	}
+	if len(l.words) > 3 {
+		return "", 0, l.diag(CodeArgCount, 3, len(l.words)-1, "Two arguments expected")
 	}
-	i, err := strconv.Atoi(words[2])
+	i, err := strconv.Atoi(l.words[2].text)
 	if err != nil {
-		return "", 0, fmt.Errorf("Second argument %s is not an integer number", words[2])
+		return "", 0, l.diag(CodeNotInteger, 2, 2, "Second argument %s is not an integer number", l.words[2].text)
 	}
-	return words[1], i, nil
+	return l.words[1].text, i, nil
 }
 
-func convertPushPop(ct CommandType, words []string) (*Command, error) {
-	segment, offset, err := checkTwoArgs(words)
-	if err != nil {
-		return nil, err
+func convertPushPop(ct CommandType, l srcLine) (*Command, *Diagnostic) {
+	segment, offset, d := checkTwoArgs(l)
+	if d != nil {
+		return nil, d
 	}
 	if !(ct == CmdPush && isValidPushSegment(segment)) && !isValidPopSegment(segment) {
-		return nil, fmt.Errorf("Invalid segment %s for %s command", segment, words[0])
+		return nil, l.diag(CodeBadSegment, 1, 1, "Invalid segment %s for %s command", segment, l.words[0].text)
 	}
 	if offset < 0 {
-		return nil, fmt.Errorf("Offset cannot be negative")
+		return nil, l.diag(CodeNegative, 2, 2, "Offset cannot be negative")
 	}
-	return &Command{ct, segment, offset}, nil
+	return &Command{CmdType: ct, Arg1: segment, Arg2: offset}, nil
 }
 
-func convertArithmetic(ct CommandType, words []string) (*Command, error) {
-	err := checkNullArgs(words)
-	if err != nil {
-		return nil, err
+func convertArithmetic(ct CommandType, l srcLine) (*Command, *Diagnostic) {
+	if d := checkNullArgs(l); d != nil {
+		return nil, d
 	}
-	return &Command{CmdType: ct, Arg1: words[0]}, nil
+	return &Command{CmdType: ct, Arg1: l.words[0].text}, nil
 }
 
-func conevrtLabeled(ct CommandType, words []string) (*Command, error) {
-	label, err := checkOneArg(words)
-	if err != nil {
-		return nil, err
+func conevrtLabeled(ct CommandType, l srcLine) (*Command, *Diagnostic) {
+	label, d := checkOneArg(l)
+	if d != nil {
+		return nil, d
 	}
 	return &Command{CmdType: ct, Arg1: label}, nil
 }
 
-func convertFunc(ct CommandType, words []string) (*Command, error) {
-	funcName, offset, err := checkTwoArgs(words)
-	if err != nil {
-		return nil, err
+func convertFunc(ct CommandType, l srcLine) (*Command, *Diagnostic) {
+	funcName, offset, d := checkTwoArgs(l)
+	if d != nil {
+		return nil, d
 	}
 	if offset < 0 {
-		return nil, fmt.Errorf("Offset cannot be negative")
+		return nil, l.diag(CodeNegative, 2, 2, "Offset cannot be negative")
 	}
-	return &Command{ct, funcName, offset}, nil
+	return &Command{CmdType: ct, Arg1: funcName, Arg2: offset}, nil
 }
 
-func convertReturn(ct CommandType, words []string) (*Command, error) {
-	err := checkNullArgs(words)
-	if err != nil {
-		return nil, err
+func convertReturn(ct CommandType, l srcLine) (*Command, *Diagnostic) {
+	if d := checkNullArgs(l); d != nil {
+		return nil, d
 	}
 	return &Command{CmdType: ct}, nil
 }
 
+// Pos is a position of a command in the source. Columns start with 1
+type Pos struct {
+	File   string `json:"file"`
+	Line   int    `json:"line"`
+	Col    int    `json:"col"`    // Column of the first character of the command
+	EndCol int    `json:"endCol"` // Column after the last character of the command
+	Text   string `json:"text"`   // Original text of the command without a comment
+}
+
+func (pos Pos) String() string {
+	if pos.File == "" {
+		return fmt.Sprintf("%d:%d", pos.Line, pos.Col)
+	}
+	return fmt.Sprintf("%s:%d:%d", pos.File, pos.Line, pos.Col)
+}
+
 // Command is a struct for a parsed VM cmd
 type Command struct {
 	CmdType CommandType
 	Arg1    string
 	Arg2    int
+	Pos     Pos
+}
+
+// word is a word of a source line with its column
+type word struct {
+	text string
+	col  int
+}
+
+// srcLine is a source line without a comment split into words
+type srcLine struct {
+	text  string
+	words []word
 }
 
 // Parser struct for parsing VM cmds line by line
 type Parser struct {
-	reader *bufio.Reader
-	lCount int
+	reader  *bufio.Reader
+	file    string
+	lCount  int
+	readErr error
+
+	// StaticLimit is a number of allowed static offsets: 0..StaticLimit-1.
+	// The total number of static vars of all files is checked by the linker
+	StaticLimit int
 }
 
 func NewParser(r *bufio.Reader) *Parser {
-	p := Parser{reader: r}
+	p := Parser{reader: r, StaticLimit: DefaultStaticLimit}
+	return &p
+}
+
+// NewParserFile creates a parser which sets the file name in the positions of commands
+func NewParserFile(r *bufio.Reader, file string) *Parser {
+	p := Parser{reader: r, file: file, StaticLimit: DefaultStaticLimit}
 	return &p
 }
 
+// ParseNext parses the next command. Errors of the VM code are returned as *Diagnostic
 func (p *Parser) ParseNext() (*Command, error) {
 	line, err := p.readNextCodeLine()
 	if err != nil {
 		return nil, err
 	}
 
-	words := strings.Fields(line)
-	if len(words) == 0 {
-		return nil, fmt.Errorf("Line %d: No words parsed", p.lCount)
+	l := srcLine{text: line, words: splitWords(line)}
+	if len(l.words) == 0 {
+		return nil, p.positioned(&Diagnostic{Code: CodeInternal, Msg: "No words parsed"})
 	}
 
-	firstWord := words[0]
+	firstWord := l.words[0].text
 	cmdType, ok := cmdTypes[firstWord]
 	if !ok {
-		return nil, fmt.Errorf("Line %d: Unknown command %s", p.lCount, firstWord)
+		return nil, p.positioned(l.diag(CodeUnknownCommand, 0, 0, "Unknown command %s", firstWord))
 	}
 
 	converter, ok := cmdConverters[cmdType]
 	if !ok {
-		return nil, fmt.Errorf(
-			"Line %d: Cannot parse line '%s' as converter is not set",
-			p.lCount, line,
-		)
+		return nil, p.positioned(l.diag(
+			CodeInternal, 0, len(l.words)-1,
+			"Cannot parse line '%s' as converter is not set", line,
+		))
 	}
-	cmd, err := converter(cmdType, words)
-	if err != nil {
-		return nil, fmt.Errorf("Line %d: %w", p.lCount, err)
+	cmd, d := converter(cmdType, l)
+	if d == nil && (cmdType == CmdPush || cmdType == CmdPop) {
+		d = p.checkOffset(cmd, l)
+	}
+	if d != nil {
+		return nil, p.positioned(d)
 	}
 
+	first, last := l.words[0], l.words[len(l.words)-1]
+	cmd.Pos = Pos{
+		File:   p.file,
+		Line:   p.lCount,
+		Col:    first.col,
+		EndCol: last.col + len(last.text),
+		Text:   line[first.col-1 : last.col-1+len(last.text)],
+	}
 	return cmd, nil
 }
 
+// checkOffset checks that the offset of a push/pop command is within its segment
+func (p *Parser) checkOffset(cmd *Command, l srcLine) *Diagnostic {
+	limit := 0
+	switch cmd.Arg1 {
+	case TempKey:
+		limit = TempSize
+	case PointerKey:
+		limit = PointerSize
+	case ConstantKey:
+		limit = MaxConstant + 1
+	case StaticKey:
+		limit = p.StaticLimit
+	default:
+		return nil
+	}
+	if cmd.Arg2 >= limit {
+		return l.diag(
+			CodeOutOfRange, 2, 2,
+			"Offset %d is out of range 0..%d of segment %s", cmd.Arg2, limit-1, cmd.Arg1,
+		)
+	}
+	return nil
+}
+
+// positioned sets the file and the current line in the diagnostic position
+func (p *Parser) positioned(d *Diagnostic) *Diagnostic {
+	d.Pos.File = p.file
+	d.Pos.Line = p.lCount
+	return d
+}
+
+// splitWords splits a line into words up to a comment
+func splitWords(line string) []word {
+	if idx := strings.Index(line, CommentPrefix); idx >= 0 {
+		line = line[:idx]
+	}
+	var words []word
+	start := -1
+	for i := 0; i <= len(line); i++ {
+		isSpace := i == len(line) || line[i] == ' ' || line[i] == '\t'
+		if isSpace && start >= 0 {
+			words = append(words, word{line[start:i], start + 1})
+			start = -1
+		} else if !isSpace && start < 0 {
+			start = i
+		}
+	}
+	return words
+}
+
+// ParseAll parses the rest of the input. A line with an error is skipped and parsing
+// goes on from the next line, so all errors of the input are returned
+func (p *Parser) ParseAll() ([]Command, []error) {
+	var cmds []Command
+	var errs []error
+	for {
+		cmd, err := p.ParseNext()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			errs = append(errs, err)
+			// A reading error cannot be recovered
+			if p.readErr != nil {
+				break
+			}
+			continue
+		}
+		cmds = append(cmds, *cmd)
+	}
+	return cmds, errs
+}
+
 func (p *Parser) readNextLine() (string, error) {
 	line, err := p.reader.ReadString('\n')
 	// In case the last line does not finish with \n
 	if err != nil && len(line) == 0 {
+		if !errors.Is(err, io.EOF) {
+			p.readErr = err
+		}
 		return "", err
 	}
 	p.lCount++
-	line = strings.Trim(line, " \t\r\n")
+	// Leading spaces are kept for the right columns
+	line = strings.TrimRight(line, " \t\r\n")
 	return line, nil
 }
 
@@ -201,7 +336,8 @@ func (p *Parser) readNextCodeLine() (string, error) {
 		if err != nil {
 			return "", err
 		}
-		if !strings.HasPrefix(line, CommentPrefix) && len(line) > 0 {
+		trimmed := strings.TrimLeft(line, " \t")
+		if !strings.HasPrefix(trimmed, CommentPrefix) && len(trimmed) > 0 {
 			return line, nil
 		}
 	}
@@ -20,47 +20,47 @@ func TestParserRegular(t *testing.T) {
 	}{
 		{
 			line: "push constant 17",
-			want: Command{CmdPush, "constant", 17},
+			want: Command{CmdType: CmdPush, Arg1: "constant", Arg2: 17},
 		},
 		{
 			line: "pop local 1",
-			want: Command{CmdPop, "local", 1},
+			want: Command{CmdType: CmdPop, Arg1: "local", Arg2: 1},
 		},
 		{
 			line: "add",
-			want: Command{CmdArithmeticBinary, "add", 0},
+			want: Command{CmdType: CmdArithmeticBinary, Arg1: "add", Arg2: 0},
 		},
 		{
 			line: "push local 100 // Comment for the command",
-			want: Command{CmdPush, "local", 100},
+			want: Command{CmdType: CmdPush, Arg1: "local", Arg2: 100},
 		},
 		{
 			line: "eq",
-			want: Command{CmdArithmeticCond, "eq", 0},
+			want: Command{CmdType: CmdArithmeticCond, Arg1: "eq", Arg2: 0},
 		},
 		{
 			line: "goto testLabel",
-			want: Command{CmdGoto, "testLabel", 0},
+			want: Command{CmdType: CmdGoto, Arg1: "testLabel", Arg2: 0},
 		},
 		{
 			line: "label testLabel",
-			want: Command{CmdLabel, "testLabel", 0},
+			want: Command{CmdType: CmdLabel, Arg1: "testLabel", Arg2: 0},
 		},
 		{
 			line: "if-goto testLabel",
-			want: Command{CmdIfGoto, "testLabel", 0},
+			want: Command{CmdType: CmdIfGoto, Arg1: "testLabel", Arg2: 0},
 		},
 		{
 			line: "function Main.test 2",
-			want: Command{CmdFunction, "Main.test", 2},
+			want: Command{CmdType: CmdFunction, Arg1: "Main.test", Arg2: 2},
 		},
 		{
 			line: "call Main.test 2",
-			want: Command{CmdCall, "Main.test", 2},
+			want: Command{CmdType: CmdCall, Arg1: "Main.test", Arg2: 2},
 		},
 		{
 			line: "return",
-			want: Command{CmdReturn, "", 0},
+			want: Command{CmdType: CmdReturn, Arg1: "", Arg2: 0},
 		},
 	}
 
@@ -72,8 +72,10 @@ func TestParserRegular(t *testing.T) {
 				t.Errorf("An error was returned: %v", err)
 				return
 			}
-			if *cmd != tc.want {
-				t.Errorf("actual: %+v; want: %+v", *cmd, tc.want)
+			actual := *cmd
+			actual.Pos = Pos{}
+			if actual != tc.want {
+				t.Errorf("actual: %+v; want: %+v", actual, tc.want)
 			}
 		})
 	}
@@ -145,3 +147,108 @@ func TestParserErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestParserAllErrors(t *testing.T) {
+	testCase := `
+	push constant 1
+	pushd local 2
+	pop local
+	// Comment
+	add
+	goto
+	`
+	parser := newParserString(testCase)
+	cmds, errs := parser.ParseAll()
+	if len(cmds) != 2 {
+		t.Errorf("Got %v commands: %+v; Expected 2 of them", len(cmds), cmds)
+	}
+	wantLines := []string{"Line 3:", "Line 4:", "Line 7:"}
+	if len(errs) != len(wantLines) {
+		t.Errorf("Got %v errors: %v; Expected %v", len(errs), errs, len(wantLines))
+		return
+	}
+	for i, err := range errs {
+		if !strings.HasPrefix(err.Error(), wantLines[i]) {
+			t.Errorf("Error %v: %v; want prefix %s", i, err, wantLines[i])
+		}
+	}
+}
+
+func TestParserPositions(t *testing.T) {
+	testCase := "// Header\n\tpush constant 7\n  add   // comment\r\nlabel  LOOP\n"
+	reader := bufio.NewReader(strings.NewReader(testCase))
+	parser := NewParserFile(reader, "Test.vm")
+	cmds, errs := parser.ParseAll()
+	if len(errs) > 0 {
+		t.Fatalf("Unexpected errors %v", errs)
+	}
+	want := []Pos{
+		{File: "Test.vm", Line: 2, Col: 2, EndCol: 17, Text: "push constant 7"},
+		{File: "Test.vm", Line: 3, Col: 3, EndCol: 6, Text: "add"},
+		{File: "Test.vm", Line: 4, Col: 1, EndCol: 12, Text: "label  LOOP"},
+	}
+	if len(cmds) != len(want) {
+		t.Fatalf("Got %v commands; want %v", len(cmds), len(want))
+	}
+	for i, w := range want {
+		if cmds[i].Pos != w {
+			t.Errorf("Command %v: actual pos %+v; want %+v", i, cmds[i].Pos, w)
+		}
+	}
+	if s := cmds[0].Pos.String(); s != "Test.vm:2:2" {
+		t.Errorf("Wrong pos string %s", s)
+	}
+}
+
+func TestParserDiagnostics(t *testing.T) {
+	testCases := []struct {
+		line string
+		code Code
+		col  int
+		text string
+	}{
+		{"pushd local 2", CodeUnknownCommand, 1, "pushd"},
+		{"push lcl 2", CodeBadSegment, 6, "lcl"},
+		{"pop constant 2", CodeBadSegment, 5, "constant"},
+		{"pop local", CodeArgCount, 1, "pop local"},
+		{"  goto L1 L2 L3", CodeArgCount, 11, "L2 L3"},
+		{"add  local // c", CodeArgCount, 6, "local"},
+		{"push local x", CodeNotInteger, 12, "x"},
+		{"call Main.f -1", CodeNegative, 13, "-1"},
+		{"pop temp 12", CodeOutOfRange, 10, "12"},
+		{"push pointer 2", CodeOutOfRange, 14, "2"},
+		{"push constant 32768", CodeOutOfRange, 15, "32768"},
+		{"push static 240", CodeOutOfRange, 13, "240"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.line, func(t *testing.T) {
+			_, err := newParserString(tc.line).ParseNext()
+			var d *Diagnostic
+			if !errors.As(err, &d) {
+				t.Fatalf("Error %v is not a diagnostic", err)
+			}
+			if d.Code != tc.code || d.Severity != SeverityError {
+				t.Errorf("Actual %v %v; want %v error", d.Severity, d.Code, tc.code)
+			}
+			if d.Pos.Line != 1 || d.Pos.Col != tc.col || d.Pos.Text != tc.text {
+				t.Errorf("Actual pos %+v; want col %v text %q", d.Pos, tc.col, tc.text)
+			}
+		})
+	}
+}
+
+func TestParserRanges(t *testing.T) {
+	testCase := "pop temp 7\npush pointer 1\npush constant 32767\npush static 239\npush local 1000\n"
+	cmds, errs := newParserString(testCase).ParseAll()
+	if len(errs) > 0 || len(cmds) != 5 {
+		t.Errorf("Got %v commands and errors %v; want 5 commands", len(cmds), errs)
+	}
+
+	parser := newParserString("push static 9\npop static 10\n")
+	parser.StaticLimit = 10
+	cmds, errs = parser.ParseAll()
+	if len(cmds) != 1 || len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "Line 2:") {
+		t.Errorf("Got commands %+v and errors %v; want the error in line 2", cmds, errs)
+	}
+}
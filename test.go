@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/verybigtuple/hackvmtranslator/translator"
+	"github.com/verybigtuple/hackvmtranslator/tstscript"
+)
+
+// runTest translates *.vm files next to every test script and runs the script
+// on the emulator comparing the output with the .cmp file
+func runTest(args []string) int {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	noBootstrap := fs.Bool(
+		"nb",
+		false,
+		"Never write the bootstrapping code. By default it is written if Sys.init is defined",
+	)
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Argument Error: Test script is not set")
+		return 1
+	}
+
+	opts := tstscript.Options{
+		Translator:    translator.Options{NoBootstrap: *noBootstrap},
+		AutoBootstrap: !*noBootstrap,
+	}
+	failed := 0
+	for _, tst := range fs.Args() {
+		res, err := tstscript.RunFile(context.Background(), tst, opts)
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "FAIL %s: %v\n", tst, err)
+			continue
+		}
+		fmt.Printf("ok   %s (%d cycles)\n", tst, res.Cycles)
+	}
+	if failed > 0 {
+		return 3
+	}
+	return 0
+}
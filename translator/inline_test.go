@@ -0,0 +1,67 @@
+package translator
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// maxProgram computes 2 * (max(3, 4) + max(10, 2)) via small leaf functions
+const maxProgram = `
+function Sys.init 1
+push constant 3
+push constant 4
+call Main.max 2
+push constant 10
+push constant 2
+call Main.max 2
+add
+call Main.double 1
+pop static 0
+label END
+goto END
+`
+
+const maxMain = `
+function Main.max 0
+push argument 0
+push argument 1
+gt
+if-goto FIRST
+push argument 1
+return
+label FIRST
+push argument 0
+return
+function Main.double 1
+push argument 0
+pop local 0
+push local 0
+push local 0
+add
+return
+`
+
+func TestTranslateInline(t *testing.T) {
+	for _, mode := range writerModes {
+		t.Run(mode.desc, func(t *testing.T) {
+			inputs := []Input{stringInput("Sys.vm", maxProgram), stringInput("Main.vm", maxMain)}
+			opts := Options{InlineMax: 10, EliminateDead: true, CodeWriter: mode.opts}
+			res, err := Translate(context.Background(), inputs, opts)
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if len(res.Inlined) != 2 || res.Inlined[0].Sites != 2 || res.Inlined[1].Sites != 1 {
+				t.Errorf("Wrong report %+v", res.Inlined)
+			}
+			if strings.Contains(res.Asm, "// call Main.") || len(res.Eliminated) != 2 {
+				t.Errorf("Inlined functions are kept:\n%s", res.Asm)
+			}
+			cpu := runAsm(t, res.Asm, 100000)
+			// Sys.init has 1 local and 2 more for the args of Main.max reused by Main.double
+			if cpu.RAM[16] != 28 || cpu.RAM[0] != 264 {
+				t.Errorf("Result %d, SP %d; want 28, 264", cpu.RAM[16], cpu.RAM[0])
+			}
+		})
+	}
+}
@@ -1,15 +1,31 @@
-package main
+package translator
 
 import "strings"
 
+// Names of the sections which are not VM files
 const (
-	bootstrap = "!!bootstrap"
-	mainf     = "!mainf"
+	bootstrap = "bootstrap"
+	mainf     = "main"
+	runtime   = "runtime"
+)
+
+// sectionRank orders the sections of the output. Sections of the same rank are ordered by name
+type sectionRank int
+
+const (
+	rankBootstrap sectionRank = iota
+	rankMain
+	rankFile
+	rankRuntime // Goes after all files
 )
 
 type trResult struct {
 	Name    string
+	Rank    sectionRank
 	Builder *strings.Builder
+	Path    string // Path of the VM file
+	Sizes   []Size // Sizes of the functions of the file
+	Fusion  Fusion
 }
 
 type resPriotityQueue []*trResult
@@ -21,6 +37,9 @@ func (pq resPriotityQueue) Len() int {
 }
 
 func (pq resPriotityQueue) Less(i, j int) bool {
+	if pq[i].Rank != pq[j].Rank {
+		return pq[i].Rank < pq[j].Rank
+	}
 	return pq[i].Name < pq[j].Name
 }
 
@@ -0,0 +1,30 @@
+package translator
+
+import (
+	"container/heap"
+	"testing"
+)
+
+func TestPriorityQueue(t *testing.T) {
+	queue := resPriotityQueue{
+		&trResult{Name: "YFile.vm", Rank: rankFile},
+		&trResult{Name: "ZFile.vm", Rank: rankFile},
+	}
+	heap.Init(&queue)
+	heap.Push(&queue, &trResult{Name: runtime, Rank: rankRuntime})
+	heap.Push(&queue, &trResult{Name: bootstrap, Rank: rankBootstrap})
+	heap.Push(&queue, &trResult{Name: mainf, Rank: rankMain})
+	heap.Push(&queue, &trResult{Name: "ÜFile.vm", Rank: rankFile})
+	heap.Push(&queue, &trResult{Name: "XFile.vm", Rank: rankFile})
+
+	// Section names do not matter, a file name sorting after the runtime goes before it
+	want := [...]string{bootstrap, mainf, "XFile.vm", "YFile.vm", "ZFile.vm", "ÜFile.vm", runtime}
+
+	for i := 0; i < len(want); i++ {
+		actual := heap.Pop(&queue).(*trResult)
+		if actual.Name != want[i] {
+			t.Errorf("%d item: %s; want: %s", i, actual.Name, want[i])
+			return
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package translator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/verybigtuple/hackvmtranslator/analysis"
+	"github.com/verybigtuple/hackvmtranslator/parser"
+)
+
+// DefaultROMSize is the number of instructions the Hack ROM holds
+const DefaultROMSize = 32768
+
+// ErrROMSize is returned by Translate if the program does not fit in ROM
+var ErrROMSize = errors.New("Program does not fit in ROM")
+
+// Size is the number of asm instructions of a function or a file.
+// Code written before the first function of a file has an empty Name
+type Size struct {
+	Name         string
+	File         string
+	Instructions int
+}
+
+// Stats are sizes of the translated program
+type Stats struct {
+	Instructions int    // Total number of instructions including the bootstrap
+	Bootstrap    int    // Instructions of the bootstrapping code
+	Runtime      int    // Instructions of the shared routines
+	Functions    []Size // Sorted by size, the largest first
+	Files        []Size // Sorted by size, the largest first
+	Fusion       Fusion
+}
+
+// Fusion counts push/pop pairs written as moves
+type Fusion struct {
+	Pairs int // Number of fused pairs
+	Saved int // Instructions saved compared to a separate push and pop
+}
+
+// instrCounter counts asm instructions, i.e. lines which are neither comments nor labels,
+// written through it. Lines may be split between writes
+type instrCounter struct {
+	w       io.Writer
+	n       int
+	inLine  bool // A non-space character of the current line has been seen
+	counted bool // The current line is an instruction
+}
+
+func (c *instrCounter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		switch {
+		case b == '\n':
+			if c.counted {
+				c.n++
+			}
+			c.inLine, c.counted = false, false
+		case b == ' ' || b == '\t' || b == '\r':
+		case !c.inLine:
+			c.inLine = true
+			c.counted = b != '/' && b != '('
+		}
+	}
+	if c.w == nil {
+		return len(p), nil
+	}
+	return c.w.Write(p)
+}
+
+// isPushPop reports if the commands start with a push immediately followed by a pop
+func isPushPop(cmds []parser.Command) bool {
+	return len(cmds) > 1 && cmds[0].CmdType == parser.CmdPush && cmds[1].CmdType == parser.CmdPop
+}
+
+// fusionSaving returns the number of instructions saved by the fusion of push/pop pairs.
+// The peephole rules and the caching of the top of the stack change the code around the pairs,
+// so the file is written once more without the fusion and the totals are compared
+func fusionSaving(
+	ctx context.Context,
+	f analysis.File,
+	stPrefix string,
+	opts Options,
+	minArgs map[string]int,
+	fused []Size,
+) (int, error) {
+	opts.FusePushPop = false
+	separate, _, err := run(ctx, f, stPrefix, opts, minArgs, nil)
+	if err != nil {
+		return 0, err
+	}
+	return totalInstructions(separate) - totalInstructions(fused), nil
+}
+
+// totalInstructions sums up the instructions of the sizes
+func totalInstructions(sizes []Size) int {
+	n := 0
+	for _, s := range sizes {
+		n += s.Instructions
+	}
+	return n
+}
+
+// sortSizes sorts sizes by the number of instructions, the largest first
+func sortSizes(sizes []Size) {
+	sort.Slice(sizes, func(i, j int) bool {
+		if sizes[i].Instructions != sizes[j].Instructions {
+			return sizes[i].Instructions > sizes[j].Instructions
+		}
+		if sizes[i].File != sizes[j].File {
+			return sizes[i].File < sizes[j].File
+		}
+		return sizes[i].Name < sizes[j].Name
+	})
+}
+
+// collectStats sums up the sizes of the translated files. Sizes of the bootstrap
+// and runtime sections are named by the sections
+func collectStats(files []*trResult) *Stats {
+	st := &Stats{}
+	for _, f := range files {
+		if f.Rank != rankFile {
+			for _, s := range f.Sizes {
+				if s.Name == bootstrap {
+					st.Bootstrap += s.Instructions
+				} else {
+					st.Runtime += s.Instructions
+				}
+				st.Instructions += s.Instructions
+			}
+			continue
+		}
+		fileSize := Size{File: f.Path}
+		for _, s := range f.Sizes {
+			fileSize.Instructions += s.Instructions
+		}
+		st.Instructions += fileSize.Instructions
+		st.Fusion.Pairs += f.Fusion.Pairs
+		st.Fusion.Saved += f.Fusion.Saved
+		st.Files = append(st.Files, fileSize)
+		st.Functions = append(st.Functions, f.Sizes...)
+	}
+	sortSizes(st.Files)
+	sortSizes(st.Functions)
+	return st
+}
+
+// checkROM returns ErrROMSize if the program is larger than the ROM
+func checkROM(st *Stats, romSize int) error {
+	if romSize <= 0 {
+		romSize = DefaultROMSize
+	}
+	if st.Instructions > romSize {
+		return fmt.Errorf("%w: %d instructions, ROM size is %d", ErrROMSize, st.Instructions, romSize)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package translator
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/verybigtuple/hackvmtranslator/assembler"
+	"github.com/verybigtuple/hackvmtranslator/codewriter"
+)
+
+func TestInstrCounter(t *testing.T) {
+	c := &instrCounter{}
+	for _, chunk := range []string{"// comm", "ent\n@S", "P\n  (LOOP)\n", "\n  D=M\n0;J", "MP\n"} {
+		c.Write([]byte(chunk))
+	}
+	if c.n != 3 {
+		t.Errorf("Counted %v instructions; want 3", c.n)
+	}
+}
+
+func TestTranslateStats(t *testing.T) {
+	inputs := func() []Input {
+		return []Input{
+			stringInput("Sys.vm", "function Sys.init 0\ncall Main.f 0\nlabel END\ngoto END\n"),
+			stringInput("Main.vm", "push constant 1\npop temp 0\nfunction Main.f 1\npush local 0\nreturn\n"),
+		}
+	}
+	res, err := Translate(context.Background(), inputs(), Options{})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	prog, err := assembler.Assemble(strings.NewReader(res.Asm))
+	if err != nil {
+		t.Fatalf("Assembler error %v", err)
+	}
+	st := res.Stats
+	if st.Instructions != len(prog.Code) {
+		t.Errorf("Counted %v instructions; assembled %v", st.Instructions, len(prog.Code))
+	}
+	if len(st.Files) != 2 || len(st.Functions) != 3 {
+		t.Fatalf("Wrong stats %+v", st)
+	}
+	sum := st.Bootstrap
+	for _, s := range st.Functions {
+		sum += s.Instructions
+	}
+	if sum != st.Instructions {
+		t.Errorf("Sum of functions %v; want %v", sum, st.Instructions)
+	}
+	for i := 1; i < len(st.Functions); i++ {
+		if st.Functions[i].Instructions > st.Functions[i-1].Instructions {
+			t.Errorf("Functions are not sorted %+v", st.Functions)
+		}
+	}
+
+	res, err = Translate(context.Background(), inputs(), Options{ROMSize: st.Instructions - 1})
+	if !errors.Is(err, ErrROMSize) || res.Stats == nil {
+		t.Errorf("Want ErrROMSize with stats, got %v", err)
+	}
+	if _, err = Translate(context.Background(), inputs(), Options{ROMSize: st.Instructions}); err != nil {
+		t.Errorf("Unexpected error %v for the exact ROM size", err)
+	}
+}
+
+func TestTranslateFusionStats(t *testing.T) {
+	inputs := func() []Input {
+		return []Input{stringInput("Main.vm",
+			"function Main.f 3\npush constant 5\npop temp 1\npush local 2\npop that 0\n"+
+				"push local 1\npush local 0\npop local 9\npush constant 0\nreturn\n")}
+	}
+	// The peephole rules and the caching change the code around the fused pairs
+	modes := []struct {
+		desc string
+		opts codewriter.Options
+	}{
+		{"Default", codewriter.Options{}},
+		{"Peephole", codewriter.Options{Peephole: codewriter.PeepholeAll}},
+		{"Cache TOS", codewriter.Options{CacheTOS: true}},
+		{"Compact", codewriter.Options{CompactCalls: true}},
+	}
+	for _, mode := range modes {
+		t.Run(mode.desc, func(t *testing.T) {
+			opts := Options{NoBootstrap: true, CodeWriter: mode.opts}
+			plain, err := Translate(context.Background(), inputs(), opts)
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			opts.FusePushPop = true
+			fused, err := Translate(context.Background(), inputs(), opts)
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if plain.Stats.Fusion != (Fusion{}) {
+				t.Errorf("Fusion without the option %+v", plain.Stats.Fusion)
+			}
+			if fused.Stats.Fusion.Pairs != 3 {
+				t.Errorf("Fused pairs %v; want 3", fused.Stats.Fusion.Pairs)
+			}
+			saved := plain.Stats.Instructions - fused.Stats.Instructions
+			if fused.Stats.Fusion.Saved != saved {
+				t.Errorf("Saved %v instructions; stats report %v", saved, fused.Stats.Fusion.Saved)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package translator
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// countProgram counts down from 1000 by the recursion which is 1000 calls deep.
+// Main.start takes more args than Main.count, so the frame is moved down
+const countProgram = `
+function Sys.init 0
+push constant 0
+push constant 1000
+push constant 7
+call Main.start 3
+pop static 0
+label END
+goto END
+`
+
+const countMain = `
+function Main.start 0
+push argument 0
+push argument 1
+call Main.count 2
+return
+function Main.count 1
+push argument 1
+if-goto REC
+push argument 0
+return
+label REC
+push argument 1
+push constant 1
+sub
+pop local 0
+push argument 0
+push constant 1
+add
+push local 0
+call Main.count 2
+return
+`
+
+func TestTranslateTailCalls(t *testing.T) {
+	for _, mode := range writerModes {
+		t.Run(mode.desc, func(t *testing.T) {
+			inputs := []Input{stringInput("Sys.vm", countProgram), stringInput("Main.vm", countMain)}
+			res, err := Translate(context.Background(), inputs, Options{TailCalls: true, CodeWriter: mode.opts})
+			if err != nil {
+				t.Fatalf("Unexpected error %v", err)
+			}
+			if strings.Count(res.Asm, "// call Main.count 2, return") != 2 {
+				t.Fatalf("There is no tail call:\n%s", res.Asm)
+			}
+			cpu := runAsm(t, res.Asm, 1000000)
+			if cpu.RAM[16] != 1000 || cpu.RAM[0] != 261 {
+				t.Errorf("Result %d, SP %d; want 1000, 261", cpu.RAM[16], cpu.RAM[0])
+			}
+			// Two frames and a few values, the stack never grows above them
+			for addr := 291; addr < 2048; addr++ {
+				if cpu.RAM[addr] != 0 {
+					t.Errorf("The stack grows up to %d", addr)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestTranslateTailCallsUnsafe(t *testing.T) {
+	// Main.f is called with 1 arg, so it cannot reuse its frame for 2 args
+	inputs := []Input{
+		stringInput("Sys.vm", "function Sys.init 0\npush constant 1\ncall Main.f 1\nreturn\n"),
+		stringInput("Main.vm", "function Main.f 0\npush constant 1\npush constant 2\ncall Main.g 2\nreturn\n"+
+			"function Main.g 0\npush argument 0\nreturn\n"),
+	}
+	res, err := Translate(context.Background(), inputs, Options{TailCalls: true})
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if strings.Contains(res.Asm, "// call Main.g 2, return") {
+		t.Errorf("Unsafe tail call:\n%s", res.Asm)
+	}
+	// Sys.init is called with 0 args by the bootstrapping code
+	if strings.Contains(res.Asm, "// call Main.f 1, return") {
+		t.Errorf("Unsafe tail call from Sys.init:\n%s", res.Asm)
+	}
+
+	// Main.f is called with 2 args inside the program, but a root may get no args
+	src := "function Main.f 0\npush constant 1\npush constant 2\ncall Main.g 2\nreturn\n" +
+		"function Main.g 0\npush constant 1\npush constant 2\ncall Main.f 2\nreturn\n"
+	for _, roots := range [][]string{nil, {"Main.f"}} {
+		inputs := []Input{stringInput("Main.vm", src)}
+		res, err := Translate(context.Background(), inputs, Options{NoBootstrap: true, TailCalls: true, Roots: roots})
+		if err != nil {
+			t.Fatalf("Unexpected error %v", err)
+		}
+		tail := strings.Contains(res.Asm, "// call Main.g 2, return")
+		if tail != (roots == nil) {
+			t.Errorf("Roots %v: tail call of Main.g is %v", roots, tail)
+		}
+	}
+}
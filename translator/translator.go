@@ -0,0 +1,520 @@
+// Package translator translates a set of VM files into a single Hack asm program
+package translator
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/verybigtuple/hackvmtranslator/analysis"
+	"github.com/verybigtuple/hackvmtranslator/codewriter"
+	"github.com/verybigtuple/hackvmtranslator/parser"
+)
+
+// ErrTranslation is returned by Translate when at least one diagnostic has been reported
+var ErrTranslation = errors.New("Errors during translation")
+
+// Input is a VM source. If Reader is nil, the file is opened by Path
+type Input struct {
+	Path   string
+	Reader io.Reader
+}
+
+// Options of the translation
+type Options struct {
+	NoBootstrap bool // Do not write the bootstrapping code
+	StaticLimit int  // Number of allowed static vars of all files. parser.DefaultStaticLimit if 0
+	// EliminateDead drops functions which cannot be called from Sys.init
+	// or from Roots if there is no bootstrap
+	EliminateDead bool
+	// Roots are the functions entered from outside the program if there is no bootstrap
+	Roots   []string
+	ROMSize int // Max number of instructions. DefaultROMSize if 0
+	// FusePushPop writes a push immediately followed by a pop as a move
+	// which does not touch the stack
+	FusePushPop bool
+	// FoldConstants folds arithmetic of constants and removes identities like neg neg
+	FoldConstants bool
+	// TailCalls writes a call immediately followed by return as a jump reusing the frame
+	// of the current function if the current function is called with enough args.
+	// Sys.init or Roots if there is no bootstrap are assumed to be entered with no args.
+	// Other functions must not be entered from outside the program with fewer args than
+	// their calls pass, e.g. by a test script, as the moved frame would overwrite live data
+	TailCalls bool
+	// InlineMax substitutes leaf functions of at most InlineMax commands at their call sites.
+	// Inlining is off if 0
+	InlineMax  int
+	CodeWriter codewriter.Options
+}
+
+// ErrNoRoots is returned if the dead function elimination has no roots
+var ErrNoRoots = errors.New("Dead function elimination needs root functions if there is no bootstrap")
+
+// Diagnostic is an error that arose while translating a file
+type Diagnostic struct {
+	File string
+	Err  error
+}
+
+func (d Diagnostic) Error() string {
+	return fmt.Sprintf("File %s: %v", d.File, d.Err)
+}
+
+func (d Diagnostic) Unwrap() error {
+	return d.Err
+}
+
+// Structured returns the error as *parser.Diagnostic. Errors which are not
+// diagnostics of the VM code, e.g. IO errors, get the code parser.CodeInternal
+func (d Diagnostic) Structured() *parser.Diagnostic {
+	var pd *parser.Diagnostic
+	if errors.As(d.Err, &pd) {
+		return pd
+	}
+	return &parser.Diagnostic{
+		Severity: parser.SeverityError,
+		Code:     parser.CodeInternal,
+		Pos:      parser.Pos{File: d.File},
+		Msg:      d.Err.Error(),
+	}
+}
+
+// Result of the translation
+type Result struct {
+	Asm         string
+	Diagnostics []Diagnostic
+	Stack       []analysis.FunctionStack // Stack analysis of all functions
+	Eliminated  []EliminatedFunction     // Functions dropped by the dead function elimination
+	Inlined     []analysis.Inlined       // Functions substituted at their call sites
+	Stats       *Stats
+}
+
+// EliminatedFunction is a function dropped by the dead function elimination
+type EliminatedFunction struct {
+	Name         string
+	File         string
+	Instructions int // Number of asm instructions saved
+}
+
+// InputFiles returns the path itself if it is a file or all *.vm files if it is a folder
+func InputFiles(path string) ([]string, error) {
+	rootPathInfo, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+
+	if rootPathInfo.IsDir() {
+		err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			if m, err := filepath.Match("*.vm", filepath.Base(path)); err != nil {
+				return err
+			} else if m {
+				matches = append(matches, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		matches = append(matches, path)
+	}
+	return matches, nil
+}
+
+// Translate parses all inputs concurrently, checks them as a whole program and
+// translates them concurrently. The results are joined: the bootstrap code goes first
+// and then the files sorted by their names
+func Translate(ctx context.Context, inputs []Input, opts Options) (*Result, error) {
+	roots := opts.Roots
+	if opts.EliminateDead && !opts.NoBootstrap {
+		roots = []string{analysis.SysInit}
+	}
+	if opts.EliminateDead && len(roots) == 0 {
+		return nil, ErrNoRoots
+	}
+
+	files, diags := Parse(ctx, inputs, opts)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	res := &Result{}
+	// Link errors of a program with parsing errors are mostly false
+	if !hasErrors(diags) {
+		linkOpts := analysis.LinkOptions{Bootstrap: !opts.NoBootstrap, StaticLimit: parser.DefaultStaticLimit}
+		if opts.StaticLimit > 0 {
+			linkOpts.StaticLimit = opts.StaticLimit
+		}
+		if opts.EliminateDead && opts.NoBootstrap {
+			linkOpts.Roots = roots
+		}
+		for _, d := range analysis.Link(files, linkOpts) {
+			diags = append(diags, Diagnostic{File: diagFile(d), Err: d})
+		}
+	}
+	if !hasErrors(diags) {
+		var stackDiags []*parser.Diagnostic
+		res.Stack, stackDiags = analysis.Stack(files)
+		for _, d := range stackDiags {
+			diags = append(diags, Diagnostic{File: d.Pos.File, Err: d})
+		}
+	}
+	// Files are processed concurrently and checked in several passes
+	sort.SliceStable(diags, func(i, j int) bool {
+		if diags[i].File != diags[j].File {
+			return diags[i].File < diags[j].File
+		}
+		return diags[i].Structured().Pos.Line < diags[j].Structured().Pos.Line
+	})
+	res.Diagnostics = diags
+	if hasErrors(diags) {
+		return res, ErrTranslation
+	}
+	if opts.InlineMax > 0 {
+		files, res.Inlined = analysis.Inline(files, opts.InlineMax)
+	}
+	if opts.FoldConstants {
+		files = analysis.FoldFiles(files)
+	}
+	if opts.EliminateDead {
+		var dead []analysis.DeadFunction
+		files, dead = analysis.Eliminate(files, roots)
+		res.Eliminated = eliminated(dead, opts)
+	}
+
+	resChan := make(chan *trResult)
+	diagChan := make(chan Diagnostic)
+	wg := &sync.WaitGroup{}
+
+	// The runtime goes to the bootstrap section or to its own one after all files
+	if !opts.NoBootstrap || opts.CodeWriter.NeedsRuntime() {
+		wg.Add(1)
+		go processBootstrap(ctx, opts, resChan, diagChan, wg)
+	}
+	var minArgs map[string]int
+	if opts.TailCalls {
+		entries := opts.Roots
+		if !opts.NoBootstrap {
+			entries = []string{analysis.SysInit}
+		}
+		minArgs = analysis.MinArgs(files, entries)
+	}
+	for _, f := range files {
+		wg.Add(1)
+		go processVMFile(ctx, f, opts, minArgs, resChan, diagChan, wg)
+	}
+
+	rq, writeDiags := gatherResults(resChan, diagChan, wg)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(writeDiags) > 0 {
+		res.Diagnostics = append(res.Diagnostics, writeDiags...)
+		return res, ErrTranslation
+	}
+
+	res.Stats = collectStats(*rq)
+	if err := checkROM(res.Stats, opts.ROMSize); err != nil {
+		return res, err
+	}
+	res.Asm = joinResults(rq)
+	return res, nil
+}
+
+// eliminated translates dead functions to count the saved instructions
+func eliminated(dead []analysis.DeadFunction, opts Options) []EliminatedFunction {
+	res := make([]EliminatedFunction, len(dead))
+	for i, d := range dead {
+		f := analysis.File{Name: d.File, Commands: d.Commands}
+		// Errors are impossible as the commands are valid
+		sizes, _, _ := run(context.Background(), f, "dead", opts, nil, ioutil.Discard)
+		res[i] = EliminatedFunction{Name: d.Name, File: d.File}
+		for _, s := range sizes {
+			res[i].Instructions += s.Instructions
+		}
+	}
+	return res
+}
+
+func hasErrors(diags []Diagnostic) bool {
+	for _, d := range diags {
+		if d.Structured().Severity == parser.SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// diagFile returns the file of a whole-program diagnostic. A diagnostic without
+// a file is about the bootstrapping code
+func diagFile(d *parser.Diagnostic) string {
+	if d.Pos.File == "" {
+		return "Bootstrap"
+	}
+	return d.Pos.File
+}
+
+// Parse parses all inputs concurrently. The files keep the order of the inputs.
+// Only parsing errors are returned: the program is not checked as a whole
+func Parse(ctx context.Context, inputs []Input, opts Options) ([]analysis.File, []Diagnostic) {
+	files := make([]analysis.File, len(inputs))
+	errs := make([][]error, len(inputs))
+	wg := &sync.WaitGroup{}
+	for i, in := range inputs {
+		wg.Add(1)
+		go func(i int, in Input) {
+			defer wg.Done()
+			files[i], errs[i] = parseInput(ctx, in, opts)
+		}(i, in)
+	}
+	wg.Wait()
+
+	var diags []Diagnostic
+	for i, fileErrs := range errs {
+		for _, err := range fileErrs {
+			diags = append(diags, Diagnostic{File: inputs[i].Path, Err: err})
+		}
+	}
+	return files, diags
+}
+
+// parseInput parses the whole input, so all parsing errors of the file are returned
+func parseInput(ctx context.Context, in Input, opts Options) (analysis.File, []error) {
+	f := analysis.File{Name: in.Path}
+	r := in.Reader
+	if r == nil {
+		inFile, err := os.Open(in.Path)
+		if err != nil {
+			return f, []error{err}
+		}
+		defer inFile.Close()
+		r = inFile
+	}
+	if err := ctx.Err(); err != nil {
+		return f, []error{err}
+	}
+
+	parser := parser.NewParserFile(bufio.NewReader(r), in.Path)
+	if opts.StaticLimit > 0 {
+		parser.StaticLimit = opts.StaticLimit
+	}
+	var errs []error
+	f.Commands, errs = parser.ParseAll()
+	return f, errs
+}
+
+// run translates the file to w and returns the sizes of its functions.
+// minArgs are the args functions are called with, see analysis.MinArgs
+func run(
+	ctx context.Context,
+	f analysis.File,
+	stPrefix string,
+	opts Options,
+	minArgs map[string]int,
+	w io.Writer,
+) ([]Size, Fusion, error) {
+	counter := &instrCounter{w: w}
+	outWriter := bufio.NewWriter(counter)
+	codeWr := codewriter.NewCodeWriter(outWriter, filepath.Base(f.Name), stPrefix, "")
+	codeWr.SetOptions(opts.CodeWriter)
+
+	var sizes []Size
+	var fusion Fusion
+	fn := ""
+	cur := Size{File: f.Name}
+	// Instructions are counted when they are flushed to the counter
+	closeSize := func() error {
+		if err := codeWr.Flush(); err != nil {
+			return err
+		}
+		if err := outWriter.Flush(); err != nil {
+			return err
+		}
+		cur.Instructions = counter.n
+		counter.n = 0
+		if cur.Name != "" || cur.Instructions > 0 {
+			sizes = append(sizes, cur)
+		}
+		return nil
+	}
+
+	for i := 0; i < len(f.Commands); i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, Fusion{}, err
+		}
+		cmd := f.Commands[i]
+		if cmd.CmdType == parser.CmdFunction {
+			if err := closeSize(); err != nil {
+				return nil, Fusion{}, err
+			}
+			cur = Size{Name: cmd.Arg1, File: f.Name}
+			fn = cmd.Arg1
+		}
+		if opts.TailCalls && analysis.IsTailCall(f.Commands[i:], fn, minArgs) {
+			if err := codeWr.WriteTailCall(cmd); err != nil {
+				return nil, Fusion{}, err
+			}
+			i++
+			continue
+		}
+		if opts.FusePushPop && isPushPop(f.Commands[i:]) {
+			if err := codeWr.WritePushPop(cmd, f.Commands[i+1]); err != nil {
+				return nil, Fusion{}, err
+			}
+			fusion.Pairs++
+			i++
+			continue
+		}
+		if err := codeWr.WriteCommand(cmd); err != nil {
+			return nil, Fusion{}, err
+		}
+	}
+	if err := closeSize(); err != nil {
+		return nil, Fusion{}, err
+	}
+	return sizes, fusion, nil
+}
+
+func send(ctx context.Context, result chan<- *trResult, res *trResult) {
+	select {
+	case result <- res:
+	case <-ctx.Done():
+	}
+}
+
+func report(ctx context.Context, diagChan chan<- Diagnostic, d Diagnostic) {
+	select {
+	case diagChan <- d:
+	case <-ctx.Done():
+	}
+}
+
+// processBootstrap writes the bootstrapping code unless it is off and the runtime routines
+func processBootstrap(
+	ctx context.Context,
+	opts Options,
+	result chan<- *trResult,
+	diagChan chan<- Diagnostic,
+	wg *sync.WaitGroup,
+) {
+	defer wg.Done()
+
+	sBuilder := &strings.Builder{}
+	counter := &instrCounter{w: sBuilder}
+	outWriter := bufio.NewWriter(counter)
+	bsCodeWriter := codewriter.NewCodeWriterBootstrap(outWriter)
+	bsCodeWriter.SetOptions(opts.CodeWriter)
+
+	name, rank := runtime, rankRuntime
+	var sizes []Size
+	if !opts.NoBootstrap {
+		name, rank = bootstrap, rankBootstrap
+		err := bsCodeWriter.WriteBootstrap()
+		if err == nil {
+			err = bsCodeWriter.Flush()
+		}
+		if err == nil {
+			err = outWriter.Flush()
+		}
+		if err != nil {
+			report(ctx, diagChan, Diagnostic{File: "Bootstrap", Err: err})
+			return
+		}
+		sizes = append(sizes, Size{Name: bootstrap, Instructions: counter.n})
+		counter.n = 0
+	}
+	err := bsCodeWriter.WriteRuntime()
+	if err == nil {
+		err = bsCodeWriter.Flush()
+	}
+	if err == nil {
+		err = outWriter.Flush()
+	}
+	if err != nil {
+		report(ctx, diagChan, Diagnostic{File: "Runtime", Err: err})
+		return
+	}
+	sizes = append(sizes, Size{Name: runtime, Instructions: counter.n})
+	send(ctx, result, &trResult{Name: name, Rank: rank, Builder: sBuilder, Sizes: sizes})
+}
+
+func processVMFile(
+	ctx context.Context,
+	f analysis.File,
+	opts Options,
+	minArgs map[string]int,
+	result chan<- *trResult,
+	diagChan chan<- Diagnostic,
+	wg *sync.WaitGroup,
+) {
+	defer wg.Done()
+
+	sBuilder := &strings.Builder{}
+	fBase := filepath.Base(f.Name)
+	stPrefix := strings.TrimSuffix(fBase, filepath.Ext(f.Name))
+	sizes, fusion, err := run(ctx, f, stPrefix, opts, minArgs, sBuilder)
+	if err == nil && fusion.Pairs > 0 {
+		fusion.Saved, err = fusionSaving(ctx, f, stPrefix, opts, minArgs, sizes)
+	}
+	if err != nil {
+		report(ctx, diagChan, Diagnostic{File: f.Name, Err: err})
+		return
+	}
+	send(ctx, result, &trResult{
+		Name:    fBase,
+		Rank:    rankFile,
+		Builder: sBuilder,
+		Path:    f.Name,
+		Sizes:   sizes,
+		Fusion:  fusion,
+	})
+}
+
+func gatherResults(r <-chan *trResult, d <-chan Diagnostic, wg *sync.WaitGroup) (*resPriotityQueue, []Diagnostic) {
+	ds := []Diagnostic{}
+	rq := resPriotityQueue{}
+	heap.Init(&rq)
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		done <- true
+	}()
+
+RLoop:
+	for {
+		select {
+		case diag := <-d:
+			ds = append(ds, diag)
+		case res := <-r:
+			heap.Push(&rq, res)
+		case <-done:
+			break RLoop
+		}
+	}
+	return &rq, ds
+}
+
+func joinResults(rq *resPriotityQueue) string {
+	sb := strings.Builder{}
+	for len(*rq) > 0 {
+		r := heap.Pop(rq).(*trResult)
+		sb.WriteString(r.Builder.String())
+	}
+	return sb.String()
+}
@@ -0,0 +1,245 @@
+package translator
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/verybigtuple/hackvmtranslator/analysis"
+	"github.com/verybigtuple/hackvmtranslator/codewriter"
+	"github.com/verybigtuple/hackvmtranslator/emulator"
+	"github.com/verybigtuple/hackvmtranslator/parser"
+)
+
+func stringInput(path, src string) Input {
+	return Input{Path: path, Reader: strings.NewReader(src)}
+}
+
+// writerModes are the codewriter options the translated programs are run with
+var writerModes = []struct {
+	desc string
+	opts codewriter.Options
+}{
+	{"Default", codewriter.Options{}},
+	{"All", codewriter.Options{CompactCalls: true, SharedCompare: true, Peephole: codewriter.PeepholeAll, CacheTOS: true}},
+}
+
+// runAsm assembles the code and runs it on the emulator until it halts
+func runAsm(t *testing.T, asm string, maxCycles int) *emulator.CPU {
+	t.Helper()
+	cpu, _, err := emulator.NewFromAsm(strings.NewReader(asm))
+	if err != nil {
+		t.Fatalf("Assembler error %v", err)
+	}
+	if err := cpu.Run(maxCycles); err != nil {
+		t.Fatalf("Emulator error %v", err)
+	}
+	return cpu
+}
+
+func TestTranslateOrder(t *testing.T) {
+	inputs := []Input{
+		stringInput("dir/Zed.vm", "push constant 1\n"),
+		stringInput("dir/Alpha.vm", "push constant 2\n"),
+		stringInput("dir/Sys.vm", "function Sys.init 0\n"),
+	}
+	res, err := Translate(context.Background(), inputs, Options{})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+		return
+	}
+
+	want := []string{"// Bootstrap", "// Alpha.vm", "// Sys.vm", "// Zed.vm"}
+	last := -1
+	for _, w := range want {
+		idx := strings.Index(res.Asm, w)
+		if idx < 0 {
+			t.Errorf("Section %q is not found", w)
+			return
+		}
+		if idx < last {
+			t.Errorf("Section %q is out of order", w)
+		}
+		last = idx
+	}
+}
+
+func TestTranslateNoBootstrap(t *testing.T) {
+	inputs := []Input{stringInput("Test.vm", "push constant 1\n")}
+	res, err := Translate(context.Background(), inputs, Options{NoBootstrap: true})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+		return
+	}
+	if !strings.HasPrefix(res.Asm, "// Test.vm") {
+		t.Errorf("Asm must start with the file section, got:\n%s", res.Asm)
+	}
+}
+
+func TestTranslateDiagnostics(t *testing.T) {
+	inputs := []Input{
+		stringInput("Good.vm", "push constant 1\n"),
+		stringInput("Bad.vm", "push constant 1\npushd local 2\npop local\n"),
+		stringInput("Alpha.vm", "add 1\n"),
+	}
+	res, err := Translate(context.Background(), inputs, Options{})
+	if !errors.Is(err, ErrTranslation) {
+		t.Errorf("Want ErrTranslation, got %v", err)
+		return
+	}
+	want := []struct {
+		file string
+		line string
+	}{
+		{"Alpha.vm", "Line 1:"},
+		{"Bad.vm", "Line 2:"},
+		{"Bad.vm", "Line 3:"},
+	}
+	if len(res.Diagnostics) != len(want) {
+		t.Errorf("Want %d diagnostics, got %v", len(want), res.Diagnostics)
+		return
+	}
+	for i, w := range want {
+		d := res.Diagnostics[i]
+		if d.File != w.file || !strings.HasPrefix(d.Err.Error(), w.line) {
+			t.Errorf("Diagnostic %d: %v; want %s %s", i, d, w.file, w.line)
+		}
+		var pd *parser.Diagnostic
+		if !errors.As(d, &pd) || d.Structured() != pd || pd.Pos.File != w.file {
+			t.Errorf("Diagnostic %d: %v must wrap a parser diagnostic of the file", i, d)
+		}
+	}
+}
+
+func TestDiagnosticStructured(t *testing.T) {
+	d := Diagnostic{File: "Missing.vm", Err: errors.New("no such file")}
+	pd := d.Structured()
+	if pd.Code != parser.CodeInternal || pd.Pos.File != "Missing.vm" || pd.Msg != "no such file" {
+		t.Errorf("Wrong structured diagnostic %+v", pd)
+	}
+}
+
+func TestTranslateStaticLimit(t *testing.T) {
+	src := "push static 5\n"
+	opts := Options{NoBootstrap: true, StaticLimit: 5}
+	_, err := Translate(context.Background(), []Input{stringInput("A.vm", src)}, opts)
+	if !errors.Is(err, ErrTranslation) {
+		t.Errorf("Want ErrTranslation, got %v", err)
+	}
+	opts.StaticLimit = 0
+	_, err = Translate(context.Background(), []Input{stringInput("A.vm", src)}, opts)
+	if err != nil {
+		t.Errorf("Unexpected error %v with the default limit", err)
+	}
+}
+
+func TestTranslateLink(t *testing.T) {
+	inputs := []Input{
+		stringInput("Main.vm", "function Main.f 0\ncall Main.g 0\ngoto END\nlabel L\nlabel L\nreturn\n"),
+		stringInput("Other.vm", "function Main.f 0\nreturn\n"),
+	}
+	res, err := Translate(context.Background(), inputs, Options{})
+	if !errors.Is(err, ErrTranslation) {
+		t.Errorf("Want ErrTranslation, got %v", err)
+		return
+	}
+	want := []struct {
+		file string
+		code parser.Code
+	}{
+		{"Bootstrap", analysis.CodeNoSysInit},
+		{"Main.vm", analysis.CodeUndefinedFunction},
+		{"Main.vm", analysis.CodeUndefinedLabel},
+		{"Main.vm", analysis.CodeDuplicateLabel},
+		{"Other.vm", analysis.CodeDuplicateFunction},
+	}
+	if len(res.Diagnostics) != len(want) {
+		t.Errorf("Want %d diagnostics, got %v", len(want), res.Diagnostics)
+		return
+	}
+	for i, w := range want {
+		d := res.Diagnostics[i]
+		if d.File != w.file || d.Structured().Code != w.code {
+			t.Errorf("Diagnostic %d: %v; want %s %s", i, d, w.file, w.code)
+		}
+	}
+}
+
+func TestTranslateStackWarnings(t *testing.T) {
+	inputs := []Input{stringInput("Main.vm", "function Main.f 0\nadd\nreturn\n")}
+	res, err := Translate(context.Background(), inputs, Options{NoBootstrap: true})
+	if err != nil {
+		t.Errorf("Warnings must not fail the translation: %v", err)
+		return
+	}
+	if len(res.Diagnostics) != 1 || res.Diagnostics[0].Structured().Code != analysis.CodeStackUnderflow {
+		t.Errorf("Want the underflow warning, got %v", res.Diagnostics)
+	}
+	if len(res.Stack) != 1 || res.Stack[0].Name != "Main.f" {
+		t.Errorf("Wrong stack analysis %+v", res.Stack)
+	}
+	if res.Asm == "" {
+		t.Errorf("Asm is not written")
+	}
+}
+
+func TestTranslateEliminateDead(t *testing.T) {
+	inputs := []Input{
+		stringInput("Sys.vm", "function Sys.init 0\ncall Sys.used 0\nreturn\nfunction Sys.used 0\npush constant 1\nreturn\n"),
+		stringInput("Lib.vm", "function Lib.dead 0\npush constant 2\nreturn\n"),
+	}
+	res, err := Translate(context.Background(), inputs, Options{EliminateDead: true})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+		return
+	}
+	if strings.Contains(res.Asm, "(Lib.dead)") || !strings.Contains(res.Asm, "(Sys.used)") {
+		t.Errorf("Wrong functions are eliminated:\n%s", res.Asm)
+	}
+	if len(res.Eliminated) != 1 || res.Eliminated[0].Name != "Lib.dead" || res.Eliminated[0].Instructions == 0 {
+		t.Errorf("Wrong eliminated functions %+v", res.Eliminated)
+	}
+
+	_, err = Translate(context.Background(), inputs, Options{EliminateDead: true, NoBootstrap: true})
+	if !errors.Is(err, ErrNoRoots) {
+		t.Errorf("Want ErrNoRoots, got %v", err)
+	}
+	opts := Options{EliminateDead: true, NoBootstrap: true, Roots: []string{"Lib.none"}}
+	res, err = Translate(context.Background(), inputs, opts)
+	if !errors.Is(err, ErrTranslation) || res.Diagnostics[0].Structured().Code != analysis.CodeUndefinedRoot {
+		t.Errorf("Want an undefined root, got %v", err)
+	}
+}
+
+func TestTranslateFoldConstants(t *testing.T) {
+	inputs := []Input{stringInput("Main.vm", "push constant 2\npush constant 3\nadd\nneg\npop temp 0\n")}
+	res, err := Translate(context.Background(), inputs, Options{NoBootstrap: true, FoldConstants: true})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+		return
+	}
+	if !strings.Contains(res.Asm, "// push constant -5\n@5\nD=-A\n") || strings.Contains(res.Asm, "// add") {
+		t.Errorf("Constants are not folded:\n%s", res.Asm)
+	}
+
+	inputs = []Input{stringInput("Main.vm", "push constant 0\nnot\npush local 0\nand\n")}
+	res, err = Translate(context.Background(), inputs, Options{NoBootstrap: true, FoldConstants: true})
+	if err != nil {
+		t.Errorf("Unexpected error %v", err)
+		return
+	}
+	if !strings.Contains(res.Asm, "// push constant -1\n@SP\nM=M+1\nA=M-1\nM=-1\n") {
+		t.Errorf("Folded true is not pushed directly:\n%s", res.Asm)
+	}
+}
+
+func TestTranslateCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	inputs := []Input{stringInput("Test.vm", "push constant 1\n")}
+	_, err := Translate(ctx, inputs, Options{})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Want context.Canceled, got %v", err)
+	}
+}
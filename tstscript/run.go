@@ -0,0 +1,164 @@
+package tstscript
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/verybigtuple/hackvmtranslator/emulator"
+	"github.com/verybigtuple/hackvmtranslator/parser"
+	"github.com/verybigtuple/hackvmtranslator/translator"
+)
+
+// CompareError is returned if the output differs from the .cmp file
+type CompareError struct {
+	Line   int
+	Want   string
+	Actual string
+}
+
+func (e *CompareError) Error() string {
+	return fmt.Sprintf("Comparison failure at line %d:\nwant:   %s\nactual: %s", e.Line, e.Want, e.Actual)
+}
+
+// Options of RunFile
+type Options struct {
+	Translator translator.Options
+	// If AutoBootstrap is set, Translator.NoBootstrap is ignored and the bootstrapping
+	// code is written only if one of the files defines Sys.init
+	AutoBootstrap bool
+}
+
+// Result of a test script run
+type Result struct {
+	Output string
+	Cycles int
+	// HaltCycles is the number of instructions executed until the program halted
+	// or Cycles if it did not halt
+	HaltCycles   int
+	Instructions int // Size of the translated program
+}
+
+// Compare compares the output with the expected one line by line ignoring trailing spaces
+func Compare(output, expected string) error {
+	actLines := splitLines(output)
+	expLines := splitLines(expected)
+	for i, want := range expLines {
+		actual := ""
+		if i < len(actLines) {
+			actual = actLines[i]
+		}
+		if actual != want {
+			return &CompareError{Line: i + 1, Want: want, Actual: actual}
+		}
+	}
+	if len(actLines) > len(expLines) {
+		return &CompareError{Line: len(expLines) + 1, Actual: actLines[len(expLines)]}
+	}
+	return nil
+}
+
+func splitLines(s string) []string {
+	lines := strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \t")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// RunFile translates all *.vm files from the folder of the test script, runs the script
+// on the emulator and compares the output with the compare-to file if it is set
+func RunFile(ctx context.Context, tstPath string, opts Options) (*Result, error) {
+	f, err := os.Open(tstPath)
+	if err != nil {
+		return nil, err
+	}
+	script, err := Parse(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("File %s: %w", tstPath, err)
+	}
+
+	dir := filepath.Dir(tstPath)
+	paths, err := translator.InputFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("There are no *.vm files in %s", dir)
+	}
+	inputs := make([]translator.Input, len(paths))
+	for i, p := range paths {
+		inputs[i] = translator.Input{Path: p}
+	}
+
+	trOpts := opts.Translator
+	if opts.AutoBootstrap {
+		hasInit, err := definesSysInit(paths)
+		if err != nil {
+			return nil, err
+		}
+		trOpts.NoBootstrap = !hasInit
+	}
+	res, err := translator.Translate(ctx, inputs, trOpts)
+	if err != nil {
+		if res != nil && len(res.Diagnostics) > 0 {
+			return nil, res.Diagnostics[0]
+		}
+		return nil, err
+	}
+
+	cpu, _, err := emulator.NewFromAsm(strings.NewReader(res.Asm))
+	if err != nil {
+		return nil, fmt.Errorf("Assembler error: %w", err)
+	}
+	r, err := script.run(cpu)
+	if err != nil {
+		return nil, fmt.Errorf("File %s: %w", tstPath, err)
+	}
+	out := r.out.String()
+	result := &Result{Output: out, Cycles: cpu.Cycles, HaltCycles: r.halted, Instructions: len(cpu.ROM)}
+	if r.halted < 0 {
+		result.HaltCycles = cpu.Cycles
+	}
+
+	if script.CompareFile != "" {
+		expected, err := ioutil.ReadFile(filepath.Join(dir, script.CompareFile))
+		if err != nil {
+			return result, err
+		}
+		if err := Compare(out, string(expected)); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func definesSysInit(paths []string) (bool, error) {
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return false, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			words := strings.Fields(scanner.Text())
+			if len(words) > 1 && words[0] == parser.FuncKey && words[1] == parser.SysInit {
+				f.Close()
+				return true, nil
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return false, err
+		}
+	}
+	return false, nil
+}
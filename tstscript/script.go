@@ -0,0 +1,411 @@
+// Package tstscript runs nand2tetris CPUEmulator test scripts (.tst) and compares
+// their output with the expected .cmp files
+package tstscript
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/verybigtuple/hackvmtranslator/emulator"
+)
+
+type stmtKind int
+
+const (
+	stmtCommand stmtKind = iota
+	stmtRepeat
+)
+
+type stmt struct {
+	kind  stmtKind
+	line  int
+	words []string
+	count int    // For repeat
+	body  []stmt // For repeat
+}
+
+// Script is a parsed test script
+type Script struct {
+	stmts []stmt
+
+	LoadFile    string // File of the load command
+	OutputFile  string // File of the output-file command
+	CompareFile string // File of the compare-to command
+}
+
+type token struct {
+	text string
+	line int
+}
+
+// Parse parses a test script
+func Parse(r io.Reader) (*Script, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := tokenize(string(data))
+	if err != nil {
+		return nil, err
+	}
+	s := &Script{}
+	pos := 0
+	s.stmts, err = parseStmts(tokens, &pos, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range s.stmts {
+		if st.kind != stmtCommand || len(st.words) < 2 {
+			continue
+		}
+		switch st.words[0] {
+		case "load":
+			s.LoadFile = st.words[1]
+		case "output-file":
+			s.OutputFile = st.words[1]
+		case "compare-to":
+			s.CompareFile = st.words[1]
+		}
+	}
+	return s, nil
+}
+
+func tokenize(src string) ([]token, error) {
+	var tokens []token
+	line := 1
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "/*"):
+			end := strings.Index(src[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("Line %d: Unclosed comment", line)
+			}
+			line += strings.Count(src[i:i+2+end], "\n")
+			i += end + 4
+		case c == ',' || c == ';' || c == '{' || c == '}':
+			tokens = append(tokens, token{string(c), line})
+			i++
+		case c == '"':
+			end := strings.IndexByte(src[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("Line %d: Unclosed string", line)
+			}
+			tokens = append(tokens, token{src[i : i+end+2], line})
+			i += end + 2
+		default:
+			start := i
+			for i < len(src) && !strings.ContainsRune(" \t\r\n,;{}", rune(src[i])) {
+				i++
+			}
+			tokens = append(tokens, token{src[start:i], line})
+		}
+	}
+	return tokens, nil
+}
+
+func parseStmts(tokens []token, pos *int, inBlock bool) ([]stmt, error) {
+	var stmts []stmt
+	var cur *stmt
+	for *pos < len(tokens) {
+		t := tokens[*pos]
+		*pos++
+		switch t.text {
+		case ",", ";":
+			if cur != nil {
+				stmts = append(stmts, *cur)
+				cur = nil
+			}
+		case "}":
+			if !inBlock {
+				return nil, fmt.Errorf("Line %d: Unexpected }", t.line)
+			}
+			if cur != nil {
+				stmts = append(stmts, *cur)
+			}
+			return stmts, nil
+		case "{":
+			if cur == nil || cur.words[0] != "repeat" || len(cur.words) != 2 {
+				return nil, fmt.Errorf("Line %d: Unexpected {", t.line)
+			}
+			n, err := strconv.Atoi(cur.words[1])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("Line %d: Illegal repeat count %s", t.line, cur.words[1])
+			}
+			body, err := parseStmts(tokens, pos, true)
+			if err != nil {
+				return nil, err
+			}
+			stmts = append(stmts, stmt{kind: stmtRepeat, line: cur.line, count: n, body: body})
+			cur = nil
+		default:
+			if cur == nil {
+				cur = &stmt{kind: stmtCommand, line: t.line}
+			}
+			cur.words = append(cur.words, t.text)
+		}
+	}
+	if inBlock {
+		return nil, fmt.Errorf("Unclosed {")
+	}
+	if cur != nil {
+		stmts = append(stmts, *cur)
+	}
+	return stmts, nil
+}
+
+type column struct {
+	name    string
+	format  byte
+	lPad    int
+	width   int
+	rPad    int
+	address int // For RAM[n]
+}
+
+type runner struct {
+	cpu     *emulator.CPU
+	columns []column
+	out     strings.Builder
+	time    int
+	halted  int // Cycles of the CPU when the program halted or -1
+}
+
+// Run executes the script on the CPU and returns its output
+func (s *Script) Run(cpu *emulator.CPU) (string, error) {
+	r, err := s.run(cpu)
+	return r.out.String(), err
+}
+
+func (s *Script) run(cpu *emulator.CPU) (*runner, error) {
+	r := &runner{cpu: cpu, halted: -1}
+	err := r.exec(s.stmts)
+	return r, err
+}
+
+func (r *runner) exec(stmts []stmt) error {
+	for _, st := range stmts {
+		if st.kind == stmtRepeat {
+			for i := 0; i < st.count; i++ {
+				if err := r.exec(st.body); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := r.command(st); err != nil {
+			return fmt.Errorf("Line %d: %w", st.line, err)
+		}
+	}
+	return nil
+}
+
+func (r *runner) command(st stmt) error {
+	switch st.words[0] {
+	case "load", "output-file", "compare-to", "echo", "clear-echo":
+		return nil
+	case "output-list":
+		return r.outputList(st.words[1:])
+	case "output":
+		r.outputValues()
+		return nil
+	case "set":
+		if len(st.words) != 3 {
+			return fmt.Errorf("set expects 2 arguments")
+		}
+		return r.set(st.words[1], st.words[2])
+	case "tick":
+		return nil
+	case "tock", "ticktock":
+		r.time++
+		if r.halted < 0 && r.cpu.Halted() {
+			r.halted = r.cpu.Cycles
+		}
+		// The ROM beyond the program is filled with zeros, so the CPU does nothing useful
+		if int(r.cpu.PC) >= len(r.cpu.ROM) {
+			r.cpu.A = 0
+			r.cpu.PC++
+			return nil
+		}
+		return r.cpu.Step()
+	}
+	return fmt.Errorf("Unsupported command %s", st.words[0])
+}
+
+func (r *runner) set(target, value string) error {
+	v, err := parseValue(value)
+	if err != nil {
+		return err
+	}
+	switch target {
+	case "A":
+		r.cpu.A = v
+	case "D":
+		r.cpu.D = v
+	case "PC":
+		r.cpu.PC = uint16(v)
+	default:
+		addr, err := parseRAM(target)
+		if err != nil {
+			return err
+		}
+		r.cpu.RAM[addr] = v
+	}
+	return nil
+}
+
+func parseValue(s string) (int16, error) {
+	base := 10
+	if len(s) > 2 && s[0] == '%' {
+		switch s[1] {
+		case 'X':
+			base = 16
+		case 'B':
+			base = 2
+		case 'D':
+		default:
+			return 0, fmt.Errorf("Illegal value %s", s)
+		}
+		s = s[2:]
+	}
+	if base == 10 {
+		v, err := strconv.ParseInt(s, 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("Illegal value %s", s)
+		}
+		return int16(v), nil
+	}
+	v, err := strconv.ParseUint(s, base, 16)
+	if err != nil {
+		return 0, fmt.Errorf("Illegal value %s", s)
+	}
+	return int16(v), nil
+}
+
+func parseRAM(s string) (int, error) {
+	if !strings.HasPrefix(s, "RAM[") || !strings.HasSuffix(s, "]") {
+		return 0, fmt.Errorf("Unknown variable %s", s)
+	}
+	addr, err := strconv.Atoi(s[4 : len(s)-1])
+	if err != nil || addr < 0 || addr >= emulator.RAMSize {
+		return 0, fmt.Errorf("Illegal RAM address %s", s)
+	}
+	return addr, nil
+}
+
+// outputList parses specs like RAM[0]%D2.6.2 and writes the header
+func (r *runner) outputList(specs []string) error {
+	r.columns = r.columns[:0]
+	for _, spec := range specs {
+		idx := strings.IndexByte(spec, '%')
+		if idx < 0 || idx+2 > len(spec) {
+			return fmt.Errorf("Illegal output spec %s", spec)
+		}
+		col := column{name: spec[:idx], format: spec[idx+1]}
+		pads := strings.Split(spec[idx+2:], ".")
+		if len(pads) != 3 {
+			return fmt.Errorf("Illegal output spec %s", spec)
+		}
+		nums := [3]int{}
+		for i, p := range pads {
+			n, err := strconv.Atoi(p)
+			if err != nil || n < 0 {
+				return fmt.Errorf("Illegal output spec %s", spec)
+			}
+			nums[i] = n
+		}
+		col.lPad, col.width, col.rPad = nums[0], nums[1], nums[2]
+		switch col.name {
+		case "A", "D", "PC", "time":
+		default:
+			addr, err := parseRAM(col.name)
+			if err != nil {
+				return err
+			}
+			col.address = addr
+		}
+		switch col.format {
+		case 'D', 'X', 'B', 'S':
+		default:
+			return fmt.Errorf("Illegal output format %s", spec)
+		}
+		r.columns = append(r.columns, col)
+	}
+
+	r.out.WriteByte('|')
+	for _, col := range r.columns {
+		total := col.lPad + col.width + col.rPad
+		name := col.name
+		if len(name) > total {
+			name = name[:total]
+		}
+		left := (total - len(name)) / 2
+		r.out.WriteString(strings.Repeat(" ", left))
+		r.out.WriteString(name)
+		r.out.WriteString(strings.Repeat(" ", total-len(name)-left))
+		r.out.WriteByte('|')
+	}
+	r.out.WriteByte('\n')
+	return nil
+}
+
+func (r *runner) outputValues() {
+	r.out.WriteByte('|')
+	for _, col := range r.columns {
+		r.out.WriteString(strings.Repeat(" ", col.lPad))
+		r.out.WriteString(col.formatValue(r.value(col)))
+		r.out.WriteString(strings.Repeat(" ", col.rPad))
+		r.out.WriteByte('|')
+	}
+	r.out.WriteByte('\n')
+}
+
+func (r *runner) value(col column) int16 {
+	switch col.name {
+	case "A":
+		return r.cpu.A
+	case "D":
+		return r.cpu.D
+	case "PC":
+		return int16(r.cpu.PC)
+	case "time":
+		return int16(r.time)
+	}
+	return r.cpu.RAM[col.address]
+}
+
+func (col column) formatValue(v int16) string {
+	var s string
+	switch col.format {
+	case 'X':
+		s = fmt.Sprintf("%04X", uint16(v))
+	case 'B':
+		s = fmt.Sprintf("%016b", uint16(v))
+	default:
+		s = strconv.Itoa(int(v))
+	}
+	if len(s) > col.width {
+		return s[len(s)-col.width:]
+	}
+	if col.format == 'S' {
+		return s + strings.Repeat(" ", col.width-len(s))
+	}
+	pad := " "
+	if col.format == 'X' || col.format == 'B' {
+		pad = "0"
+	}
+	return strings.Repeat(pad, col.width-len(s)) + s
+}
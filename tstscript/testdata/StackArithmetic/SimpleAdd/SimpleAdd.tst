@@ -0,0 +1,12 @@
+load SimpleAdd.asm,
+output-file SimpleAdd.out,
+compare-to SimpleAdd.cmp,
+output-list RAM[0]%D2.6.2 RAM[256]%D2.6.2;
+
+set RAM[0] 256,  // initializes the stack pointer
+
+repeat 60 {      // enough cycles to complete the execution
+  ticktock;
+}
+
+output;          // the stack pointer and the stack base
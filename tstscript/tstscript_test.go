@@ -0,0 +1,153 @@
+package tstscript
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/verybigtuple/hackvmtranslator/codewriter"
+	"github.com/verybigtuple/hackvmtranslator/emulator"
+	"github.com/verybigtuple/hackvmtranslator/translator"
+)
+
+func TestCourseScripts(t *testing.T) {
+	scripts, err := filepath.Glob(filepath.Join("testdata", "*", "*", "*.tst"))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if len(scripts) == 0 {
+		t.Fatalf("No test scripts found")
+	}
+	modes := []struct {
+		desc string
+		opts translator.Options
+	}{
+		{"default", translator.Options{}},
+		{"compact", translator.Options{CodeWriter: codewriter.Options{CompactCalls: true}}},
+		{"shared-compare", translator.Options{CodeWriter: codewriter.Options{SharedCompare: true}}},
+		{"peephole", translator.Options{CodeWriter: codewriter.Options{Peephole: codewriter.PeepholeAll}}},
+		{"fuse", translator.Options{FusePushPop: true}},
+		{"fold", translator.Options{FoldConstants: true}},
+		{"cache-tos", translator.Options{CodeWriter: codewriter.Options{CacheTOS: true}}},
+		{"tail-calls", translator.Options{TailCalls: true}},
+		{"inline", translator.Options{InlineMax: 10}},
+	}
+	for _, mode := range modes {
+		for _, tst := range scripts {
+			name := mode.desc + "/" + strings.TrimSuffix(filepath.Base(tst), ".tst")
+			t.Run(name, func(t *testing.T) {
+				opts := Options{Translator: mode.opts, AutoBootstrap: true}
+				res, err := RunFile(context.Background(), tst, opts)
+				if err != nil {
+					t.Errorf("%v", err)
+					if res != nil {
+						t.Logf("Output:\n%s", res.Output)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestScriptRun(t *testing.T) {
+	src := `
+	/* Multiline
+	   comment */
+	load Test.asm,
+	output-list RAM[0]%D1.6.1 D%X1.4.1 A%B0.16.0 RAM[16]%D2.4.0;
+	set RAM[0] -7,
+	set RAM[16] %X10,
+	repeat 2 { ticktock; }
+	output;
+	`
+	script, err := Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if script.LoadFile != "Test.asm" {
+		t.Errorf("Wrong load file %s", script.LoadFile)
+	}
+
+	// D=-1; A=5
+	cpu := emulator.New([]uint16{0b1110111010010000, 5})
+	out, err := script.Run(cpu)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	want := "| RAM[0] |  D   |       A        |RAM[16|\n" +
+		"|     -7 | FFFF |0000000000000101|    16|\n"
+	if out != want {
+		t.Errorf("Actual:\n%s\nwant:\n%s", out, want)
+	}
+}
+
+func TestScriptErrors(t *testing.T) {
+	testCases := []struct {
+		desc string
+		src  string
+	}{
+		{"Unknown command", "jump 5;"},
+		{"Unclosed repeat", "repeat 5 { ticktock;"},
+		{"Illegal spec", "output-list RAM[0]%D1.6;"},
+		{"Illegal variable", "set R1 5;"},
+		{"Illegal value", "set RAM[0] x;"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.desc, func(t *testing.T) {
+			script, err := Parse(strings.NewReader(tc.src))
+			if err == nil {
+				_, err = script.Run(emulator.New(nil))
+			}
+			if err == nil {
+				t.Errorf("Error is not arisen")
+			}
+		})
+	}
+}
+
+func TestCompare(t *testing.T) {
+	if err := Compare("|  1 |\n|  2 |\n", "|  1 |\r\n|  2 |  \r\n"); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+	err := Compare("|  1 |\n|  3 |\n", "|  1 |\n|  2 |\n")
+	cmpErr, ok := err.(*CompareError)
+	if !ok || cmpErr.Line != 2 {
+		t.Errorf("Want comparison failure at line 2, got %v", err)
+	}
+}
+
+func TestCacheTOSImprovements(t *testing.T) {
+	scripts, err := filepath.Glob(filepath.Join("testdata", "*", "*", "*.tst"))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	run := func(tst string, cwOpts codewriter.Options) *Result {
+		t.Helper()
+		opts := Options{Translator: translator.Options{CodeWriter: cwOpts}, AutoBootstrap: true}
+		res, err := RunFile(context.Background(), tst, opts)
+		if err != nil {
+			t.Fatalf("%s: %v", tst, err)
+		}
+		return res
+	}
+	var plainSize, cachedSize, plainCycles, cachedCycles int
+	for _, tst := range scripts {
+		plain := run(tst, codewriter.Options{})
+		cached := run(tst, codewriter.Options{CacheTOS: true})
+		t.Logf("%-20s instructions %5d -> %5d, cycles %6d -> %6d",
+			strings.TrimSuffix(filepath.Base(tst), ".tst"),
+			plain.Instructions, cached.Instructions, plain.HaltCycles, cached.HaltCycles)
+		if cached.Instructions > plain.Instructions || cached.HaltCycles > plain.HaltCycles {
+			t.Errorf("%s: caching makes the program larger or slower", tst)
+		}
+		plainSize += plain.Instructions
+		cachedSize += cached.Instructions
+		plainCycles += plain.HaltCycles
+		cachedCycles += cached.HaltCycles
+	}
+	t.Logf("Total instructions %d -> %d, cycles %d -> %d", plainSize, cachedSize, plainCycles, cachedCycles)
+	if cachedSize >= plainSize || cachedCycles >= plainCycles {
+		t.Errorf("Caching does not improve the programs")
+	}
+}
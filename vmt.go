@@ -1,241 +1,381 @@
 package main
 
 import (
-	"bufio"
-	"container/heap"
+	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
 
+	"github.com/verybigtuple/hackvmtranslator/analysis"
+	"github.com/verybigtuple/hackvmtranslator/assembler"
 	"github.com/verybigtuple/hackvmtranslator/codewriter"
 	"github.com/verybigtuple/hackvmtranslator/parser"
+	"github.com/verybigtuple/hackvmtranslator/translator"
 )
 
-func parseCmdline() (inPath, outFilePath string, noBootstrap bool, err error) {
+// Output formats
+const (
+	formatAsm  = "asm"
+	formatHack = "hack"
+)
+
+// Diagnostic formats
+const (
+	diagText = "text"
+	diagJSON = "json"
+)
+
+type cmdArgs struct {
+	inPath      string
+	outFilePath string
+	noBootstrap bool
+	format      string
+	diagnostics string
+	staticLimit int
+	stack       bool
+	dce         bool
+	roots       string
+	stats       bool
+	romSize     int
+	compact     bool
+	sharedCmp   bool
+	peephole    codewriter.PeepholeRules
+	fuse        bool
+	fold        bool
+	cacheTOS    bool
+	tailCalls   bool
+	inlineMax   int
+}
+
+func parseCmdline() (args cmdArgs, err error) {
 	inFileFlag := flag.String("in", "", "Input file or folder with *.vm files")
-	outFileFlag := flag.String("out", "", "Output file. Usually has the extension '.asm'")
+	outFileFlag := flag.String("out", "", "Output file. Usually has the extension '.asm' or '.hack'")
 	flag.BoolVar(
-		&noBootstrap,
+		&args.noBootstrap,
 		"nb",
 		false,
 		"Translator does not write the bootstrapping code to a result asm file",
 	)
+	flag.StringVar(
+		&args.format,
+		"format",
+		formatAsm,
+		"Output format: 'asm' for Hack assembly or 'hack' for Hack machine code",
+	)
+	flag.StringVar(
+		&args.diagnostics,
+		"diagnostics",
+		diagText,
+		"Diagnostics format: 'text' or 'json'",
+	)
+	flag.IntVar(
+		&args.staticLimit,
+		"static-limit",
+		parser.DefaultStaticLimit,
+		"Number of allowed static vars of all files",
+	)
+	flag.BoolVar(&args.stack, "stack", false, "Print the worst-case stack depth of every function")
+	flag.BoolVar(
+		&args.dce,
+		"dce",
+		false,
+		"Drop functions which cannot be called from Sys.init or from -roots if -nb is set",
+	)
+	flag.StringVar(&args.roots, "roots", "", "Comma separated root functions of -dce if -nb is set")
+	flag.BoolVar(&args.stats, "stats", false, "Print the number of instructions of every file and function")
+	flag.IntVar(&args.romSize, "rom", translator.DefaultROMSize, "Max number of instructions of the program")
+	flag.BoolVar(
+		&args.compact,
+		"compact",
+		false,
+		"Call and return via shared routines instead of inlining them at every site",
+	)
+	flag.BoolVar(
+		&args.sharedCmp,
+		"shared-cmp",
+		false,
+		"Compute eq, gt and lt via shared routines instead of inlining them",
+	)
+	flag.BoolVar(
+		&args.fuse,
+		"fuse",
+		false,
+		"Write a push immediately followed by a pop as a move which does not touch the stack",
+	)
+	flag.BoolVar(&args.fold, "fold", false, "Fold arithmetic of constants and remove identities like neg neg")
+	flag.BoolVar(
+		&args.cacheTOS,
+		"cache-tos",
+		false,
+		"Keep the top of the stack in the D-register within basic blocks",
+	)
+	flag.BoolVar(
+		&args.tailCalls,
+		"tail-calls",
+		false,
+		"Write a call followed by return as a jump reusing the frame of the current function",
+	)
+	flag.IntVar(
+		&args.inlineMax,
+		"inline",
+		0,
+		"Inline leaf functions of at most N commands at their call sites. Off if 0",
+	)
+	peepholeFlag := flag.String(
+		"peephole",
+		"",
+		"Peephole rules: 'all' or a comma separated list of pushpop, redundant-at, jump-next",
+	)
 	flag.Parse()
 
-	inPath = *inFileFlag
-	if inPath == "" {
+	if args.peephole, err = codewriter.ParsePeepholeRules(*peepholeFlag); err != nil {
+		return
+	}
+	if args.format != formatAsm && args.format != formatHack {
+		err = fmt.Errorf("Unknown output format %s", args.format)
+		return
+	}
+	if args.diagnostics != diagText && args.diagnostics != diagJSON {
+		err = fmt.Errorf("Unknown diagnostics format %s", args.diagnostics)
+		return
+	}
+
+	args.inPath = *inFileFlag
+	if args.inPath == "" {
 		if flag.Arg(0) == "" {
 			err = fmt.Errorf("Input file/folder is not set")
 			return
 		}
-		inPath = flag.Arg(0)
+		args.inPath = flag.Arg(0)
 	}
 
-	outFilePath = *outFileFlag
-	if outFilePath == "" {
+	args.outFilePath = *outFileFlag
+	if args.outFilePath == "" {
 		if flag.Arg(1) == "" {
-			info, erri := os.Stat(inPath)
+			info, erri := os.Stat(args.inPath)
 			if erri != nil {
 				err = fmt.Errorf("Illegal input path: %w", erri)
 				return
 			}
+			ext := "." + args.format
 			if info.IsDir() {
-				outFilePath = filepath.Join(inPath, filepath.Base(inPath)+".asm")
+				args.outFilePath = filepath.Join(args.inPath, filepath.Base(args.inPath)+ext)
 			} else {
-				fn := strings.TrimSuffix(filepath.Base(inPath), filepath.Ext(inPath))
-				asmFn := fn + ".asm"
-				outFilePath = filepath.Join(filepath.Dir(inPath), asmFn)
+				fn := strings.TrimSuffix(filepath.Base(args.inPath), filepath.Ext(args.inPath))
+				args.outFilePath = filepath.Join(filepath.Dir(args.inPath), fn+ext)
 			}
 		} else {
-			outFilePath = flag.Arg(1)
+			args.outFilePath = flag.Arg(1)
 		}
 	}
 
 	return
 }
 
-func getInputFiles(path string) ([]string, error) {
-	rootPathInfo, err := os.Stat(path)
+func writeOutFile(filePath string, content string) (err error) {
+	outFile, err := os.Create(filePath)
 	if err != nil {
-		return nil, err
+		err = fmt.Errorf("Cannot create output file: %w", err)
+		return
 	}
-	var matches []string
-
-	if rootPathInfo.IsDir() {
-		err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if info.IsDir() {
-				return nil
-			}
-			if m, err := filepath.Match("*.vm", filepath.Base(path)); err != nil {
-				return err
-			} else if m {
-				matches = append(matches, path)
-			}
-			return nil
-		})
-		if err != nil {
-			return nil, err
+	defer func() {
+		cerr := outFile.Close()
+		if cerr != nil {
+			err = fmt.Errorf("Cannot close output file: %w", cerr)
 		}
-	} else {
-		matches = append(matches, path)
+	}()
+
+	_, err = outFile.WriteString(content)
+	if err != nil {
+		return
 	}
-	return matches, nil
+	fmt.Printf("Output file saved as %v\n", filePath)
+	return
 }
 
-func run(writerName, stPrefix string, inReader *bufio.Reader, outWriter *bufio.Writer) error {
-	parser := parser.NewParser(inReader)
-	codeWr := codewriter.NewCodeWriter(outWriter, writerName, stPrefix, "")
-	for {
-		cmd, err := parser.ParseNext()
-		if errors.Is(err, io.EOF) {
-			break
-		}
-		if err != nil {
-			return err
+// printDiagnostics prints diagnostics grouped by file. They are already sorted by the translator
+func printDiagnostics(diags []translator.Diagnostic) {
+	file := ""
+	for i, d := range diags {
+		if i == 0 || d.File != file {
+			file = d.File
+			fmt.Fprintf(os.Stderr, "File %s:\n", file)
 		}
-		if err := codeWr.WriteCommand(*cmd); err != nil {
-			return err
+		if d.Structured().Severity == parser.SeverityWarning {
+			fmt.Fprintf(os.Stderr, "  warning: %v\n", d.Err)
+		} else {
+			fmt.Fprintf(os.Stderr, "  %v\n", d.Err)
 		}
 	}
-	err := outWriter.Flush()
-	return err
 }
 
-func processBootstrap(result chan<- *trResult, errChan chan<- error, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	sBuilder := &strings.Builder{}
-	outWriter := bufio.NewWriter(sBuilder)
-	bsCodeWriter := codewriter.NewCodeWriterBootstrap(outWriter)
-	err := bsCodeWriter.WriteBootstrap()
-	if err != nil {
-		errChan <- err
-		return
+// printDiagnosticsJSON prints diagnostics as a JSON array, which is empty if there are none
+func printDiagnosticsJSON(diags []translator.Diagnostic) {
+	list := make([]*parser.Diagnostic, len(diags))
+	for i, d := range diags {
+		list[i] = d.Structured()
+	}
+	enc := json.NewEncoder(os.Stderr)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(list); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 	}
-	outWriter.Flush()
-	result <- &trResult{bootstrap, sBuilder}
 }
 
-func processVMFile(
-	filePath string,
-	result chan<- *trResult,
-	errChan chan<- error,
-	wg *sync.WaitGroup,
-) {
-	defer wg.Done()
-
-	inFile, err := os.Open(filePath)
-	if err != nil {
-		errChan <- err
+// printStack prints the worst-case stack depth of every function
+func printStack(funcs []analysis.FunctionStack) {
+	for _, f := range funcs {
+		fmt.Printf("%-40s %5d\n", f.Name, f.MaxDepth)
 	}
-	defer inFile.Close()
-
-	fmt.Printf("Reading file %s\n", filePath)
-
-	inReader := bufio.NewReader(inFile)
-	sBuilder := &strings.Builder{}
-	outWriter := bufio.NewWriter(sBuilder)
+}
 
-	fBase := filepath.Base(filePath)
-	stPrefix := strings.TrimSuffix(fBase, filepath.Ext(filePath))
-	err = run(fBase, stPrefix, inReader, outWriter)
-	if err != nil {
-		errChan <- fmt.Errorf("File %s: %w", filePath, err)
-		return
+// printEliminated prints the number of dropped functions and saved instructions
+func printEliminated(funcs []translator.EliminatedFunction) {
+	saved := 0
+	for _, f := range funcs {
+		saved += f.Instructions
 	}
-	outWriter.Flush()
-	result <- &trResult{Name: fBase, Builder: sBuilder}
+	fmt.Printf("Eliminated %d dead functions, %d instructions saved\n", len(funcs), saved)
 }
 
-func gatherResults(r <-chan *trResult, e <-chan error, wg *sync.WaitGroup) (*resPriotityQueue, []error) {
-	es := []error{}
-	rq := resPriotityQueue{}
-	heap.Init(&rq)
-
-	done := make(chan bool)
-	go func() {
-		wg.Wait()
-		done <- true
-	}()
-
-RLoop:
-	for {
-		select {
-		case err := <-e:
-			es = append(es, err)
-		case res := <-r:
-			heap.Push(&rq, res)
-		case <-done:
-			break RLoop
-		}
+// printInlined prints the functions substituted at their call sites
+func printInlined(funcs []analysis.Inlined) {
+	sites := 0
+	for _, f := range funcs {
+		fmt.Printf("Inlined %s (%s): %d commands at %d call sites\n", f.Name, f.File, f.Commands, f.Sites)
+		sites += f.Sites
 	}
-	return &rq, es
+	fmt.Printf("Inlined %d functions at %d call sites\n", len(funcs), sites)
 }
 
-func writeAsmFile(filePath string, rq *resPriotityQueue) (err error) {
-	outFile, err := os.Create(filePath)
-	if err != nil {
-		err = fmt.Errorf("Cannot create output file: %w", err)
-		return
+// printStats prints the sizes of files and functions, the largest first
+func printStats(st *translator.Stats, romSize int) {
+	fmt.Printf("Instructions: %d of %d ROM\n", st.Instructions, romSize)
+	fmt.Printf("Bootstrap:    %d\n", st.Bootstrap)
+	fmt.Printf("Runtime:      %d\n", st.Runtime)
+	if st.Fusion.Pairs > 0 {
+		fmt.Printf("Fused:        %d push/pop pairs, %d instructions saved\n", st.Fusion.Pairs, st.Fusion.Saved)
 	}
-	defer func() {
-		cerr := outFile.Close()
-		if cerr != nil {
-			err = fmt.Errorf("Cannot close output file: %w", cerr)
+	fmt.Println("Files:")
+	for _, s := range st.Files {
+		fmt.Printf("  %6d  %s\n", s.Instructions, s.File)
+	}
+	fmt.Println("Functions:")
+	for _, s := range st.Functions {
+		name := s.Name
+		if name == "" {
+			name = "<outside functions>"
 		}
-	}()
+		fmt.Printf("  %6d  %-40s %s\n", s.Instructions, name, s.File)
+	}
+}
 
-	for len(*rq) > 0 {
-		r := heap.Pop(rq).(*trResult)
-		_, err = outFile.WriteString(r.Builder.String())
+func assembleHack(asm string) (string, error) {
+	prog, err := assembler.Assemble(strings.NewReader(asm))
+	if err != nil {
+		return "", fmt.Errorf("Assembler error: %w", err)
 	}
-	fmt.Printf("Asm file saved as %v\n", filePath)
-	return
+	sb := strings.Builder{}
+	err = assembler.WriteHack(&sb, prog.Code)
+	return sb.String(), err
 }
 
 func main() {
-	inFilePath, outFilePath, noBoot, err := parseCmdline()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "diff":
+			os.Exit(runDiff(os.Args[2:]))
+		case "test":
+			os.Exit(runTest(os.Args[2:]))
+		case "graph":
+			os.Exit(runGraph(os.Args[2:]))
+		}
+	}
+
+	args, err := parseCmdline()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, fmt.Sprintf("Argument Error: %v", err))
 		os.Exit(1)
 	}
 
-	inPaths, err := getInputFiles(inFilePath)
+	inPaths, err := translator.InputFiles(args.inPath)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, fmt.Sprintf("Cannot get input file or directory: %v", err))
 		os.Exit(2)
 	}
 
-	resChan := make(chan *trResult)
-	errChan := make(chan error)
-	wg := &sync.WaitGroup{}
+	inputs := make([]translator.Input, 0, len(inPaths))
+	for _, p := range inPaths {
+		fmt.Printf("Reading file %s\n", p)
+		inputs = append(inputs, translator.Input{Path: p})
+	}
 
-	if !noBoot {
-		wg.Add(1)
-		go processBootstrap(resChan, errChan, wg)
+	opts := translator.Options{
+		NoBootstrap:   args.noBootstrap,
+		StaticLimit:   args.staticLimit,
+		EliminateDead: args.dce,
+		ROMSize:       args.romSize,
+		FusePushPop:   args.fuse,
+		FoldConstants: args.fold,
+		TailCalls:     args.tailCalls,
+		InlineMax:     args.inlineMax,
+		CodeWriter: codewriter.Options{
+			CompactCalls:  args.compact,
+			SharedCompare: args.sharedCmp,
+			Peephole:      args.peephole,
+			CacheTOS:      args.cacheTOS,
+		},
 	}
-	for _, inPath := range inPaths {
-		wg.Add(1)
-		go processVMFile(inPath, resChan, errChan, wg)
+	if args.roots != "" {
+		opts.Roots = strings.Split(args.roots, ",")
 	}
-
-	resultQueue, allErrs := gatherResults(resChan, errChan, wg)
-	if len(allErrs) > 0 {
-		fmt.Fprintln(os.Stderr, "Errors during translation:")
-		for _, err := range allErrs {
+	res, err := translator.Translate(context.Background(), inputs, opts)
+	if args.diagnostics == diagJSON && res != nil {
+		printDiagnosticsJSON(res.Diagnostics)
+	}
+	if err != nil {
+		// Stats help to find what does not fit in ROM
+		if args.stats && res != nil && res.Stats != nil {
+			printStats(res.Stats, args.romSize)
+		}
+		if !errors.Is(err, translator.ErrTranslation) {
 			fmt.Fprintln(os.Stderr, err)
+		} else if args.diagnostics == diagText {
+			fmt.Fprintln(os.Stderr, "Errors during translation:")
+			printDiagnostics(res.Diagnostics)
 		}
 		os.Exit(3)
 	}
-	err = writeAsmFile(outFilePath, resultQueue)
+	if args.diagnostics == diagText && len(res.Diagnostics) > 0 {
+		fmt.Fprintln(os.Stderr, "Warnings:")
+		printDiagnostics(res.Diagnostics)
+	}
+	if args.stack {
+		printStack(res.Stack)
+	}
+	if args.dce {
+		printEliminated(res.Eliminated)
+	}
+	if args.inlineMax > 0 {
+		printInlined(res.Inlined)
+	}
+	if args.stats {
+		printStats(res.Stats, args.romSize)
+	}
+
+	out := res.Asm
+	if args.format == formatHack {
+		out, err = assembleHack(out)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(3)
+		}
+	}
+	err = writeOutFile(args.outFilePath, out)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(3)